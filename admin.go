@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/xormplus/xorm"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+// 提交的状态
+const (
+	SubmissionPending  = "pending"
+	SubmissionApproved = "approved"
+	SubmissionRejected = "rejected"
+)
+
+// sessionCookie 管理员登录后的 cookie 名
+const sessionCookie = "v6sc_session"
+
+// sessionTTL 登录的有效期
+const sessionTTL = 12 * time.Hour
+
+// loginLimit 每个来源地址连续登录失败 5 次后，每分钟只能再失败一次，空闲的记录会被 RateLimiter 清理
+var loginLimit = &RateLimiter{PerLogin: rate.Every(time.Minute), Burst: 5, limiters: map[string]*rate.Limiter{}}
+
+// sessionKey 签名 cookie 的密钥，没有指定 --session-key 时每次启动随机生成
+var sessionKey []byte
+
+// User struct
+// 管理员，密码用 bcrypt 保存，用 --add-admin 添加
+type User struct {
+	ID       int       `json:"id" xorm:"pk autoincr 'id'"`
+	Name     string    `json:"name" xorm:"name unique"`
+	Password string    `json:"-" xorm:"password"`
+	Created  time.Time `json:"created" xorm:"created"`
+	Updated  time.Time `json:"updated" xorm:"updated"`
+}
+
+// Submission struct
+// 用户通过 addsite 提交的域名，管理员通过后才加入 site 表，见 checkSubmission
+type Submission struct {
+	ID          int       `json:"id" xorm:"pk autoincr 'id'"`
+	Domain      string    `json:"domain" xorm:"domain index"`
+	Desc        string    `json:"desc" xorm:"desc"`
+	SkipVariant bool      `json:"skip_variant" xorm:"skip_variant"`
+	State       string    `json:"state" xorm:"state index"`
+	IP          string    `json:"ip" xorm:"ip index"` //提交者的地址
+	UserAgent   string    `json:"user_agent" xorm:"user_agent"`
+	Reason      string    `json:"reason" xorm:"reason"`     //拒绝的原因
+	SID         int       `json:"sid" xorm:"sid"`           //通过后创建的站点
+	Reviewer    string    `json:"reviewer" xorm:"reviewer"` //处理此提交的管理员
+	Created     time.Time `json:"created" xorm:"created"`
+	Updated     time.Time `json:"updated" xorm:"updated"`
+}
+
+func initSessionKey() {
+	sessionKey = []byte(*scSessionKey)
+	if len(sessionKey) == 0 {
+		sessionKey = make([]byte, 32)
+		if _, e := rand.Read(sessionKey); e != nil {
+			panic(e)
+		}
+	}
+}
+
+// addUser 从 r 读取一行作为密码，添加管理员或者修改已有管理员的密码
+func addUser(name string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan()
+	var password = strings.TrimSpace(scanner.Text())
+	if name == "" || len(password) < 8 {
+		return errors.New("name is empty or password is shorter than 8 characters")
+	}
+	hash, e := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if e != nil {
+		return e
+	}
+	var user = User{Name: name}
+	has, e := db.Get(&user)
+	if e != nil {
+		return e
+	}
+	user.Password = string(hash)
+	if has {
+		_, e = db.ID(user.ID).Cols("password").Update(&user)
+		return e
+	}
+	_, e = db.Insert(&user)
+	return e
+}
+
+// dummyHash 用户不存在时也比较一次，使响应时间不泄露用户名是否存在
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("v6sc"), bcrypt.DefaultCost)
+
+func checkPassword(name, password string) bool {
+	var hash = dummyHash
+	var has bool
+	if name != "" {
+		var user = User{Name: name}
+		var e error
+		if has, e = db.Get(&user); e != nil {
+			panic(e)
+		}
+		if has {
+			hash = []byte(user.Password)
+		}
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && has
+}
+
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newSession cookie 的值为 base64(用户名|过期时间).签名
+func newSession(name string, expire time.Time) string {
+	var payload = name + "|" + strconv.FormatInt(expire.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + sign(payload)
+}
+
+// parseSession 返回 cookie 中的用户名，签名不对或者已经过期时返回空
+func parseSession(value string, now time.Time) string {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return ""
+	}
+	b, e := base64.RawURLEncoding.DecodeString(value[:i])
+	if e != nil {
+		return ""
+	}
+	var payload = string(b)
+	if subtle.ConstantTimeCompare([]byte(sign(payload)), []byte(value[i+1:])) != 1 {
+		return ""
+	}
+	j := strings.LastIndex(payload, "|")
+	if j < 0 {
+		return ""
+	}
+	expire, e := strconv.ParseInt(payload[j+1:], 10, 64)
+	if e != nil || now.Unix() > expire {
+		return ""
+	}
+	return payload[:j]
+}
+
+// adminUser 返回请求的管理员，Authorization: Bearer <--admin-token> 或者登录后的 cookie
+func adminUser(req *http.Request) string {
+	if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); *adminToken != "" && subtle.ConstantTimeCompare([]byte(*adminToken), []byte(token)) == 1 {
+		return "token"
+	}
+	if c, e := req.Cookie(sessionCookie); e == nil {
+		return parseSession(c.Value, time.Now())
+	}
+	return ""
+}
+
+// adminAuth 只允许管理员访问
+func adminAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if adminUser(req) != "" {
+			h(w, req, ps)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: "需要管理员登录"})
+		w.Write(msg)
+	}
+}
+
+func adminReply(w http.ResponseWriter, er Er) {
+	w.Header().Set("Content-Type", "application/json")
+	msg, _ := json.Marshal(er)
+	w.Write(msg)
+}
+
+// adminLogin 用户名和密码，或者 --admin-token 登录
+func adminLogin(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var ip = remoteIP(req)
+	if loginLimit.LoginBlocked(ip) {
+		log.Printf("admin login throttled RemoteAddr %s", req.RemoteAddr)
+		w.WriteHeader(http.StatusTooManyRequests)
+		adminReply(w, Er{Ret: "e", Msg: "登录失败次数太多，请稍后再试"})
+		return
+	}
+	var name = req.FormValue("name")
+	var token = req.FormValue("token")
+	if token != "" {
+		if *adminToken == "" || subtle.ConstantTimeCompare([]byte(*adminToken), []byte(token)) != 1 {
+			name = ""
+		} else {
+			name = "token"
+		}
+	} else if !checkPassword(name, req.FormValue("password")) {
+		name = ""
+	}
+	if name == "" {
+		log.Printf("admin login failed RemoteAddr %s name %s", req.RemoteAddr, req.FormValue("name"))
+		loginLimit.LoginFailed(ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		adminReply(w, Er{Ret: "e", Msg: "用户名或密码错误"})
+		return
+	}
+	var expire = time.Now().Add(sessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    newSession(name, expire),
+		Path:     "/",
+		Expires:  expire,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	log.Printf("admin %s logged in RemoteAddr %s", name, req.RemoteAddr)
+	adminReply(w, Er{Ret: "v", Msg: name})
+}
+
+func adminLogout(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	adminReply(w, Er{Ret: "v"})
+}
+
+// adminHTML 管理页面，未登录时只显示登录表单
+func adminHTML(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var user = adminUser(req)
+	var submissions []Submission
+	var blocks []Block
+	if user != "" {
+		if e := db.Where("state = ?", SubmissionPending).Asc("id").Limit(200, 0).Find(&submissions); e != nil {
+			panic(e)
+		}
+		if e := db.Desc("id").Find(&blocks); e != nil {
+			panic(e)
+		}
+	}
+	t, e := template.ParseFiles("views/admin.html")
+	if e != nil {
+		panic(e)
+	}
+	t.Execute(w, map[string]interface{}{"user": user, "submissions": submissions, "blocks": blocks})
+}
+
+// formSite 读取 id 参数对应的站点
+func formSite(req *http.Request, key string) (Site, bool) {
+	var id, _ = strconv.Atoi(req.FormValue(key))
+	var site = Site{ID: id}
+	if id <= 0 {
+		return site, false
+	}
+	has, e := db.Get(&site)
+	if e != nil {
+		panic(e)
+	}
+	return site, has
+}
+
+// adminEditSite 修改域名、描述和是否检测另一种写法，域名改变时重新检测
+func adminEditSite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	site, ok := formSite(req, "id")
+	if !ok {
+		adminReply(w, Er{Ret: "e", Msg: "没有这个记录"})
+		return
+	}
+	var domain = normalizeDomain(req.FormValue("domain"))
+	if prompt := checkDomain(domain); prompt != "" {
+		adminReply(w, Er{Ret: "e", Msg: prompt})
+		return
+	}
+	//www 和主域名算同一个站点，跳过站点自身
+	has, e := db.In("domain", variantDomains(domain)).And("id != ?", site.ID).Exist(&Site{})
+	if e != nil {
+		panic(e)
+	}
+	if has {
+		adminReply(w, Er{Ret: "e", Msg: "此域名已有记录，可以合并"})
+		return
+	}
+	var changed = domain != site.Domain
+	site.Domain = domain
+	site.Desc = req.FormValue("desc")
+	site.SkipVariant = req.FormValue("variant") == "0"
+	if _, e := db.ID(site.ID).Cols("domain", "desc", "skip_variant").Update(&site); e != nil {
+		panic(e)
+	}
+	log.Printf("admin %s edited site %d %s", adminUser(req), site.ID, site.Domain)
+	if changed {
+		enqueue(site)
+	}
+	adminReply(w, Er{Ret: "v", Msg: "已保存"})
+}
+
+// deleteSite 删除站点及其标签、检测目标、任务和检测记录
+func deleteSite(s *xorm.Session, id int) error {
+	for _, bean := range []interface{}{&Lable{}, &Target{}, &Job{}, &Vantage{}, &ProbeResult{}} {
+		if _, e := s.Where("sid = ?", id).Delete(bean); e != nil {
+			return e
+		}
+	}
+	_, e := s.ID(id).Delete(&Site{})
+	return e
+}
+
+func adminDeleteSite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	site, ok := formSite(req, "id")
+	if !ok {
+		adminReply(w, Er{Ret: "e", Msg: "没有这个记录"})
+		return
+	}
+	s := db.NewSession()
+	defer s.Close()
+	if e := s.Begin(); e != nil {
+		panic(e)
+	}
+	if e := deleteSite(s, site.ID); e != nil {
+		s.Rollback()
+		panic(e)
+	}
+	if e := s.Commit(); e != nil {
+		panic(e)
+	}
+	log.Printf("admin %s deleted site %d %s", adminUser(req), site.ID, site.Domain)
+	adminReply(w, Er{Ret: "v", Msg: "已删除"})
+}
+
+// mergeSite 把 from 的标签、检测目标和检测记录移到 into，然后删除 from
+func mergeSite(s *xorm.Session, from, into Site) error {
+	var lables []Lable
+	if e := s.Where("sid = ?", from.ID).Find(&lables); e != nil {
+		return e
+	}
+	for _, l := range lables {
+		has, e := s.Where("sid = ? and classify = ? and lable = ?", into.ID, l.Classify, l.Lable).Exist(&Lable{})
+		if e != nil {
+			return e
+		}
+		if !has {
+			if _, e := s.Insert(&Lable{SID: into.ID, Classify: l.Classify, Lable: l.Lable}); e != nil {
+				return e
+			}
+		}
+	}
+	for _, bean := range []interface{}{&Target{}, &ProbeResult{}} {
+		if _, e := s.Table(bean).Where("sid = ?", from.ID).Update(map[string]interface{}{"sid": into.ID}); e != nil {
+			return e
+		}
+	}
+	if into.Desc == "" && from.Desc != "" {
+		if _, e := s.ID(into.ID).Cols("desc").Update(&Site{Desc: from.Desc}); e != nil {
+			return e
+		}
+	}
+	return deleteSite(s, from.ID)
+}
+
+// adminMergeSite 把重复的站点 id 合并到 into
+func adminMergeSite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	from, ok := formSite(req, "id")
+	into, ok2 := formSite(req, "into")
+	if !ok || !ok2 || from.ID == into.ID {
+		adminReply(w, Er{Ret: "e", Msg: "没有这个记录"})
+		return
+	}
+	s := db.NewSession()
+	defer s.Close()
+	if e := s.Begin(); e != nil {
+		panic(e)
+	}
+	if e := mergeSite(s, from, into); e != nil {
+		s.Rollback()
+		panic(e)
+	}
+	if e := s.Commit(); e != nil {
+		panic(e)
+	}
+	log.Printf("admin %s merged site %d %s into %d %s", adminUser(req), from.ID, from.Domain, into.ID, into.Domain)
+	adminReply(w, Er{Ret: "v", Msg: "已合并"})
+}
+
+// adminRelabel 用 label 参数替换站点的全部标签，每个 label 为 classify:lable
+func adminRelabel(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	site, ok := formSite(req, "id")
+	if !ok {
+		adminReply(w, Er{Ret: "e", Msg: "没有这个记录"})
+		return
+	}
+	req.ParseForm()
+	var lables []Lable
+	for _, v := range req.Form["label"] {
+		kv := strings.SplitN(strings.TrimSpace(v), ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			adminReply(w, Er{Ret: "e", Msg: fmt.Sprintf("标签 %s 应为 分类:标签", v)})
+			return
+		}
+		lables = append(lables, Lable{SID: site.ID, Classify: kv[0], Lable: kv[1]})
+	}
+	s := db.NewSession()
+	defer s.Close()
+	if e := s.Begin(); e != nil {
+		panic(e)
+	}
+	if _, e := s.Where("sid = ?", site.ID).Delete(&Lable{}); e != nil {
+		s.Rollback()
+		panic(e)
+	}
+	for i := range lables {
+		if _, e := s.Insert(&lables[i]); e != nil {
+			s.Rollback()
+			panic(e)
+		}
+	}
+	if e := s.Commit(); e != nil {
+		panic(e)
+	}
+	log.Printf("admin %s relabeled site %d %s: %v", adminUser(req), site.ID, site.Domain, req.Form["label"])
+	adminReply(w, Er{Ret: "v", Msg: "已保存"})
+}
+
+// errBlocked 提交之后才添加的屏蔽同样适用于审核
+var errBlocked = errors.New("submission is blocked")
+
+// approve 为提交创建站点，域名已经有记录时直接关联到该站点
+func approve(ctx context.Context, sub Submission, reviewer string) (Submission, error) {
+	if blocked(sub.Domain, sub.IP) {
+		return sub, errBlocked
+	}
+	var site = Site{Domain: sub.Domain}
+	has, e := db.Get(&site)
+	if e != nil {
+		return sub, e
+	}
+	if !has {
+		if site, e = createSite(ctx, sub.Domain, sub.Desc, sub.SkipVariant); e != nil {
+			return sub, e
+		}
+	}
+	sub.State, sub.SID, sub.Reviewer = SubmissionApproved, site.ID, reviewer
+	_, e = db.ID(sub.ID).Cols("state", "sid", "reviewer").Update(&sub)
+	return sub, e
+}
+
+func adminApprove(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var id, _ = strconv.Atoi(req.FormValue("id"))
+	var sub = Submission{ID: id}
+	has, e := db.Get(&sub)
+	if e != nil {
+		panic(e)
+	}
+	if id <= 0 || !has || sub.State != SubmissionPending {
+		adminReply(w, Er{Ret: "e", Msg: "没有待审核的记录"})
+		return
+	}
+	if sub, e = approve(req.Context(), sub, adminUser(req)); e == errBlocked {
+		adminReply(w, Er{Ret: "e", Msg: "此域名或提交者已被屏蔽，请拒绝"})
+		return
+	} else if e != nil {
+		panic(e)
+	}
+	log.Printf("admin %s approved submission %d %s", sub.Reviewer, sub.ID, sub.Domain)
+	adminReply(w, Er{Ret: "v", Msg: "已通过", Data: sub})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Agent 探测节点，从服务器领取任务，在本地检测后上报
+type Agent struct {
+	Server   string
+	ID       string
+	Token    string
+	Location string
+	Client   *http.Client
+}
+
+// runAgent 节点模式的入口，收到退出信号后等正在检测的站点上报完再返回
+func runAgent(a *Agent) {
+	var s = newScheduler(*maxRoutineNum, *jobTimeout, func(ctx context.Context, job *Job) checkResult {
+		return prober.Check(ctx, job.Site)
+	}, a.report)
+	s.Limit = prober.Limit
+	s.Start()
+	var quit = make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	var t = time.NewTicker(time.Second * 30)
+	defer t.Stop()
+	log.Printf("agent %s (%s) pulling from %s", a.ID, a.Location, a.Server)
+	for {
+		//队列空了再领取，避免领取的任务超时
+		if s.Len() == 0 {
+			jobs, e := a.pull(s.Workers)
+			if e != nil {
+				log.Printf("pull jobs: %s", e)
+			}
+			for _, j := range jobs {
+				s.Submit(Job{ID: j.Job, SID: j.Site.ID, Site: j.Site})
+			}
+			if len(jobs) > 0 {
+				continue
+			}
+		}
+		select {
+		case <-quit:
+			log.Printf("agent shutting down, %d queued jobs dropped", s.Len())
+			s.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (a *Agent) pull(n int) ([]agentJob, error) {
+	var res struct {
+		Er
+		Data []agentJob `json:"data"`
+	}
+	if e := a.post(fmt.Sprintf("/agent/jobs?n=%d", n), nil, &res); e != nil {
+		return nil, e
+	}
+	return res.Data, nil
+}
+
+// report 上报一个任务的结果，由调度器在同一个 goroutine 中依次调用
+func (a *Agent) report(job Job, r checkResult) {
+	var body = agentReport{Job: job.ID, Location: a.Location, Site: r.Site, Probes: r.Probes}
+	if r.Err != nil {
+		body.Error = r.Err.Error()
+	}
+	var res Er
+	if e := a.post("/agent/results", body, &res); e != nil {
+		log.Printf("report job %d: %s", job.ID, e)
+		return
+	}
+	log.Printf("job %d %s reported", job.ID, job.Site.Domain)
+}
+
+func (a *Agent) post(path string, body interface{}, res interface{}) error {
+	b, e := json.Marshal(body)
+	if e != nil {
+		return e
+	}
+	req, e := http.NewRequest("POST", strings.TrimSuffix(a.Server, "/")+path, bytes.NewReader(b))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Agent-ID", a.ID)
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	resp, e := a.Client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	if e := json.NewDecoder(resp.Body).Decode(res); e != nil {
+		return e
+	}
+	return nil
+}
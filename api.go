@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiJSON 写出 /api/v1 的应答，status 不是 200 时 Ret 为 e
+func apiJSON(w http.ResponseWriter, status int, er Er) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	msg, _ := json.Marshal(er)
+	w.Write(msg)
+}
+
+// sitePage /api/v1/sites 的 data
+type sitePage struct {
+	Sites []Site `json:"sites"`
+	Next  string `json:"next"` //下一页的 cursor，最后一页为空
+}
+
+// siteDetail /api/v1/sites/:id 的 data
+type siteDetail struct {
+	Site    Site     `json:"site"`
+	Labels  []Lable  `json:"labels"`
+	Targets []Target `json:"targets"`
+}
+
+// apiSites 站点列表，参数见 parseSiteQuery，data.next 为下一页的 cursor
+func apiSites(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	q, e := parseSiteQuery(req.URL.Query())
+	if e != nil {
+		apiJSON(w, http.StatusBadRequest, Er{Ret: "e", Msg: e.Error()})
+		return
+	}
+	sites, next, e := q.Find()
+	if e != nil {
+		panic(e)
+	}
+	if sites == nil {
+		sites = []Site{}
+	}
+	apiJSON(w, http.StatusOK, Er{Ret: "v", Data: sitePage{Sites: sites, Next: next}})
+}
+
+// apiSite 一个站点及其标签和检测目标
+func apiSite(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	var site = Site{ID: id}
+	if id <= 0 {
+		apiJSON(w, http.StatusBadRequest, Er{Ret: "e", Msg: "id must be a positive integer"})
+		return
+	}
+	res, e := db.Get(&site)
+	if e != nil {
+		panic(e)
+	}
+	if !res {
+		apiJSON(w, http.StatusNotFound, Er{Ret: "e", Msg: "site not found"})
+		return
+	}
+	var lables = []Lable{}
+	if e := db.Where("sid = ?", id).Find(&lables); e != nil {
+		panic(e)
+	}
+	var targets = []Target{}
+	if e := db.Where("sid = ?", id).Asc("id").Find(&targets); e != nil {
+		panic(e)
+	}
+	site.Targets = targets
+	apiJSON(w, http.StatusOK, Er{Ret: "v", Data: siteDetail{Site: site, Labels: lables, Targets: targets}})
+}
+
+// labelCount 每个标签下的站点数
+type labelCount struct {
+	Classify string `json:"classify"`
+	Lable    string `json:"label"`
+	Count    int    `json:"count"`
+}
+
+// apiLabels 所有标签，可以用 classify 筛选
+func apiLabels(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var s = db.Table("lable").Select("classify, lable, count(distinct sid) as count")
+	if classify := req.URL.Query().Get("classify"); classify != "" {
+		s = s.Where("classify = ?", classify)
+	}
+	var labels = []labelCount{}
+	if e := s.GroupBy("classify, lable").Asc("classify", "lable").Find(&labels); e != nil {
+		panic(e)
+	}
+	apiJSON(w, http.StatusOK, Er{Ret: "v", Data: labels})
+}
+
+// siteStats 符合条件的站点总数，以及每个协议族有地址和支持各协议的站点数
+func siteStats(q siteQuery) (map[string]int64, error) {
+	var stats = make(map[string]int64)
+	var e error
+	if stats["count"], e = q.Count(); e != nil {
+		return nil, e
+	}
+	for _, family := range []int{4, 6} {
+		q.Family = family
+		q.Support = ""
+		var prefix = "v" + strconv.Itoa(family)
+		if stats[prefix], e = q.Count(); e != nil {
+			return nil, e
+		}
+		for support := range supportCols {
+			q.Support = support
+			if stats[prefix+support], e = q.Count(); e != nil {
+				return nil, e
+			}
+		}
+	}
+	return stats, nil
+}
+
+// apiStats 统计，可以用 classify label 限定范围
+func apiStats(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var q = siteQuery{Classify: req.URL.Query().Get("classify"), Label: req.URL.Query().Get("label")}
+	stats, e := siteStats(q)
+	if e != nil {
+		panic(e)
+	}
+	apiJSON(w, http.StatusOK, Er{Ret: "v", Data: stats})
+}
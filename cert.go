@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// CertInfo struct
+// 某个地址通过 https 返回的证书，以及本次连接协商的参数
+type CertInfo struct {
+	IP          string    `json:"ip"`
+	Family      int       `json:"family"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	SANs        []string  `json:"sans"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`   //整条证书链中最早的过期时间
+	Fingerprint string    `json:"fingerprint"` //叶子证书的 sha256
+	HostMatch   bool      `json:"host_match"`  //证书是否包含检测的域名
+	ChainValid  bool      `json:"chain_valid"` //能否用系统证书验证到根
+	KeyType     string    `json:"key_type"`    //RSA ECDSA Ed25519
+	KeyBits     int       `json:"key_bits"`
+	SigAlg      string    `json:"sig_alg"`
+	Version     string    `json:"version"` //TLS 1.2 TLS 1.3 ...
+	Cipher      string    `json:"cipher"`
+	Error       string    `json:"error,omitempty"` //验证失败的原因
+}
+
+// inspectConfig 握手时不验证证书，由 inspect 自己验证，这样无效的证书也能记录下来
+func (pr *Prober) inspectConfig() *tls.Config {
+	var conf = &tls.Config{}
+	if pr.TLSConfig != nil {
+		conf = pr.TLSConfig.Clone()
+	}
+	conf.InsecureSkipVerify = true
+	return conf
+}
+
+// inspect 记录证书信息并按 tls 的规则验证，返回的错误与 tls 握手失败时一致
+func (pr *Prober) inspect(domain string, ip string, family int, state *tls.ConnectionState) (CertInfo, error) {
+	var info = CertInfo{
+		IP:      ip,
+		Family:  family,
+		Version: tls.VersionName(state.Version),
+		Cipher:  tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) == 0 {
+		info.Error = "no certificate"
+		return info, fmt.Errorf("tls: %s", info.Error)
+	}
+	var leaf = state.PeerCertificates[0]
+	var sum = sha256.Sum256(leaf.Raw)
+	info.Subject = leaf.Subject.String()
+	info.Issuer = leaf.Issuer.String()
+	info.SANs = append(info.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.NotBefore = leaf.NotBefore
+	info.Fingerprint = hex.EncodeToString(sum[:])
+	info.SigAlg = leaf.SignatureAlgorithm.String()
+	info.KeyType, info.KeyBits = keyInfo(leaf.PublicKey)
+	for _, c := range state.PeerCertificates {
+		if info.NotAfter.IsZero() || c.NotAfter.Before(info.NotAfter) {
+			info.NotAfter = c.NotAfter
+		}
+	}
+
+	var opts = x509.VerifyOptions{Intermediates: x509.NewCertPool(), CurrentTime: pr.Now()}
+	if pr.TLSConfig != nil {
+		opts.Roots = pr.TLSConfig.RootCAs
+	}
+	for _, c := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, chainErr := leaf.Verify(opts)
+	hostErr := leaf.VerifyHostname(domain)
+	info.ChainValid, info.HostMatch = chainErr == nil, hostErr == nil
+	var e = chainErr
+	if e == nil {
+		e = hostErr
+	}
+	if e != nil {
+		info.Error = e.Error()
+		return info, &tls.CertificateVerificationError{UnverifiedCertificates: state.PeerCertificates, Err: e}
+	}
+	return info, nil
+}
+
+func keyInfo(key interface{}) (string, int) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+	return fmt.Sprintf("%T", key), 0
+}
+
+// certMismatch v4 和 v6 返回了不同的证书，或者只有一边的证书无效
+func certMismatch(certs []CertInfo) bool {
+	var fingerprint = map[int]map[string]bool{4: {}, 6: {}}
+	var invalid = map[int]bool{}
+	for _, c := range certs {
+		fingerprint[c.Family][c.Fingerprint] = true
+		if c.Error != "" {
+			invalid[c.Family] = true
+		}
+	}
+	if len(fingerprint[4]) == 0 || len(fingerprint[6]) == 0 {
+		return false
+	}
+	if invalid[4] != invalid[6] {
+		return true
+	}
+	for f := range fingerprint[6] {
+		if !fingerprint[4][f] {
+			return true
+		}
+	}
+	return false
+}
+
+// certTitle 列出某个协议族每个地址的证书
+func certTitle(site Site, v int) string {
+	var lines []string
+	for _, c := range site.Certs {
+		if c.Family != v {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", c.IP, c.Subject))
+		lines = append(lines, fmt.Sprintf("颁发者 %s", c.Issuer))
+		lines = append(lines, fmt.Sprintf("%s %d %s %s", c.KeyType, c.KeyBits, c.Version, c.Cipher))
+		if c.Error != "" {
+			lines = append(lines, c.Error)
+		}
+	}
+	return tooltip(lines...)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// maxSubHosts 一个页面最多检查的第三方域名数
+const maxSubHosts = 50
+
+// resourceAttr 需要检查的标签以及保存资源地址的属性
+var resourceAttr = map[string]string{
+	"script": "src",
+	"link":   "href",
+	"img":    "src",
+	"iframe": "src",
+}
+
+// linkRels 会被浏览器加载的 link，canonical alternate dns-prefetch preconnect manifest 等只是链接或提示，不算子资源
+var linkRels = map[string]bool{
+	"stylesheet":    true,
+	"icon":          true,
+	"preload":       true,
+	"modulepreload": true,
+}
+
+// loadedLink link 的 rel 中有 linkRels 中的值，rel 可以有多个值，比如 shortcut icon
+func loadedLink(n *xhtml.Node) bool {
+	for _, a := range n.Attr {
+		if a.Key != "rel" {
+			continue
+		}
+		for _, rel := range strings.Fields(strings.ToLower(a.Val)) {
+			if linkRels[rel] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// crawl 解析首页，检查脚本、样式、图片、iframe 所在的第三方域名是否有 AAAA 记录
+// body 为空时用第一个能访问的 v6 地址重新获取首页
+func (pr *Prober) crawl(ctx context.Context, site *Site, body []byte) {
+	site.SubHosts, site.V6Full, site.Blockers = 0, 0, nil
+	var base *url.URL
+	for _, a := range site.Addrs {
+		if a.Family != 6 {
+			continue
+		}
+		var scheme = "http"
+		if a.Hs == StatusOK {
+			scheme = "https"
+		} else if a.Hp != StatusOK {
+			continue
+		}
+		base = &url.URL{Scheme: scheme, Host: site.Domain, Path: "/"}
+		if body == nil {
+			_, b, e := pr.fetch(ctx, base.String(), a.IP)
+			if e != nil {
+				continue
+			}
+			body = b
+		}
+		break
+	}
+	if base == nil || body == nil {
+		return
+	}
+	var hosts = subHosts(base, body)
+	if len(hosts) > maxSubHosts {
+		hosts = hosts[:maxSubHosts]
+	}
+	var ready int
+	for _, h := range hosts {
+		if pr.hasAAAA(ctx, h) {
+			ready++
+		} else {
+			site.Blockers = append(site.Blockers, h)
+		}
+	}
+	site.SubHosts = len(hosts)
+	site.V6Full = 100
+	if len(hosts) > 0 {
+		site.V6Full = ready * 100 / len(hosts)
+	}
+}
+
+// subHosts 返回页面引用的第三方域名，已排序去重
+func subHosts(base *url.URL, body []byte) []string {
+	doc, e := xhtml.Parse(strings.NewReader(string(body)))
+	if e != nil {
+		return nil
+	}
+	var seen = map[string]bool{}
+	var walk func(n *xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		if n.Type == xhtml.ElementNode {
+			if attr, ok := resourceAttr[n.Data]; ok && (n.Data != "link" || loadedLink(n)) {
+				for _, a := range n.Attr {
+					if a.Key != attr {
+						continue
+					}
+					u, e := base.Parse(strings.TrimSpace(a.Val))
+					if e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+						continue
+					}
+					if h := strings.ToLower(u.Hostname()); h != "" && h != base.Hostname() {
+						seen[h] = true
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	var hosts []string
+	for h := range seen {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// hasAAAA 地址本身是 v6 或者解析出了 v6 地址
+func (pr *Prober) hasAAAA(ctx context.Context, host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4() == nil
+	}
+	addrs, e := pr.Resolver.LookupHost(ctx, host)
+	if e != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCrawl 在搜索结果中显示子资源的 v6 比例，鼠标悬停列出不支持 v6 的域名
+func checkCrawl(site Site) string {
+	if site.SubHosts == 0 {
+		return ""
+	}
+	var class = "btn-success"
+	if site.V6Full < 100 {
+		class = "btn-warning"
+	}
+	var lines = []string{fmt.Sprintf("%d 个第三方域名", site.SubHosts)}
+	if len(site.Blockers) > 0 {
+		lines = append(lines, "不支持 v6:")
+	}
+	for _, h := range site.Blockers {
+		lines = append(lines, h)
+	}
+	return fmt.Sprintf(`<button type="button" class="btn %s btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">%d%%</button>`, class, tooltip(lines...), site.V6Full)
+}
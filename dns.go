@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSRecord struct
+// 一次 A 或 AAAA 查询的结果
+type DNSRecord struct {
+	Type   string   `json:"type"`   //A 或 AAAA
+	Rcode  string   `json:"rcode"`  //NOERROR NXDOMAIN SERVFAIL ...
+	Server string   `json:"server"` //实际应答的服务器
+	CNAME  []string `json:"cname"`  //从查询的域名开始的 CNAME 链
+	Addrs  []string `json:"addrs"`
+	TTL    uint32   `json:"ttl"`  //应答记录中最小的 TTL
+	Time   int64    `json:"time"` //查询耗时，包括跟随 CNAME，毫秒
+	Error  string   `json:"error,omitempty"`
+}
+
+// DNSClient 直接向指定的服务器分别查询 A 和 AAAA
+// 实现了 Resolver，测试时可以把 Servers 指向本地的 dns.Server
+type DNSClient struct {
+	Servers []string //host:port，按顺序尝试
+	Net     string   //udp 或 tcp
+	Timeout time.Duration
+}
+
+// newDNSClient servers 为空时读取 /etc/resolv.conf
+func newDNSClient(servers []string, network string) (*DNSClient, error) {
+	if len(servers) == 0 {
+		conf, e := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if e != nil {
+			return nil, e
+		}
+		for _, s := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(s, conf.Port))
+		}
+	}
+	for i, s := range servers {
+		if _, _, e := net.SplitHostPort(s); e != nil {
+			servers[i] = net.JoinHostPort(s, "53")
+		}
+	}
+	if network == "" {
+		network = "udp"
+	}
+	return &DNSClient{Servers: servers, Net: network, Timeout: time.Second * 5}, nil
+}
+
+// LookupHost 与 net.Resolver 一样返回所有地址，域名不存在时返回 IsNotFound 的 *net.DNSError
+func (c *DNSClient) LookupHost(ctx context.Context, host string) ([]string, error) {
+	records, e := c.Lookup(ctx, host)
+	if e != nil {
+		return nil, e
+	}
+	var addrs []string
+	for _, r := range records {
+		addrs = append(addrs, r.Addrs...)
+	}
+	return addrs, nil
+}
+
+// Lookup 分别查询 A 和 AAAA，两个都失败时才返回错误
+func (c *DNSClient) Lookup(ctx context.Context, host string) ([]DNSRecord, error) {
+	var records []DNSRecord
+	var found bool
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var start = time.Now()
+		r, e := c.query(ctx, host, qtype)
+		r.Time = int64(time.Since(start) / time.Millisecond)
+		if e != nil {
+			r.Error = e.Error()
+			lastErr = e
+		}
+		if len(r.Addrs) > 0 {
+			found = true
+		}
+		records = append(records, r)
+	}
+	if found {
+		return records, nil
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return records, lastErr
+}
+
+// query 查询一种记录，应答里只有 CNAME 时沿着 CNAME 继续查询
+func (c *DNSClient) query(ctx context.Context, host string, qtype uint16) (DNSRecord, error) {
+	var record = DNSRecord{Type: dns.TypeToString[qtype]}
+	var name = dns.Fqdn(host)
+	for hop := 0; hop < 8; hop++ {
+		in, server, e := c.Exchange(ctx, name, qtype)
+		if e != nil {
+			return record, &net.DNSError{Err: e.Error(), Name: host, Server: server, IsTimeout: isTimeout(e)}
+		}
+		record.Server = server
+		record.Rcode = dns.RcodeToString[in.Rcode]
+		if in.Rcode == dns.RcodeNameError {
+			return record, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			return record, &net.DNSError{Err: record.Rcode, Name: host, Server: server}
+		}
+		var next string
+		for _, rr := range in.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if record.TTL == 0 || rr.Header().Ttl < record.TTL {
+				record.TTL = rr.Header().Ttl
+			}
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				record.CNAME = append(record.CNAME, strings.TrimSuffix(v.Target, "."))
+				name, next = v.Target, v.Target
+			case *dns.A:
+				record.Addrs = append(record.Addrs, v.A.String())
+			case *dns.AAAA:
+				record.Addrs = append(record.Addrs, v.AAAA.String())
+			}
+		}
+		if len(record.Addrs) > 0 || next == "" {
+			return record, nil
+		}
+	}
+	return record, &net.DNSError{Err: "too many CNAME", Name: host}
+}
+
+// Exchange 依次向每个服务器发出查询，返回第一个应答和应答的服务器
+func (c *DNSClient) Exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, string, error) {
+	var m = new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(4096, false)
+	var client = &dns.Client{Net: c.Net, Timeout: c.Timeout}
+	var lastErr = errors.New("no dns server")
+	var last string
+	for _, server := range c.Servers {
+		last = server
+		in, _, e := client.ExchangeContext(ctx, m, server)
+		if e == nil && in.Truncated && c.Net != "tcp" {
+			in, _, e = (&dns.Client{Net: "tcp", Timeout: c.Timeout}).ExchangeContext(ctx, m, server)
+		}
+		if e != nil {
+			lastErr = fmt.Errorf("%s: %w", server, e)
+			continue
+		}
+		return in, server, nil
+	}
+	return nil, last, lastErr
+}
+
+func isTimeout(e error) bool {
+	var netErr net.Error
+	return errors.As(e, &netErr) && netErr.Timeout()
+}
+
+// LookupNS 与 net.Resolver 的同名方法一致
+func (c *DNSClient) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	answer, e := c.answer(ctx, name, dns.TypeNS)
+	var ns []*net.NS
+	for _, rr := range answer {
+		if v, ok := rr.(*dns.NS); ok {
+			ns = append(ns, &net.NS{Host: v.Ns})
+		}
+	}
+	return ns, e
+}
+
+// LookupMX 与 net.Resolver 的同名方法一致
+func (c *DNSClient) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answer, e := c.answer(ctx, name, dns.TypeMX)
+	var mx []*net.MX
+	for _, rr := range answer {
+		if v, ok := rr.(*dns.MX); ok {
+			mx = append(mx, &net.MX{Host: v.Mx, Pref: v.Preference})
+		}
+	}
+	return mx, e
+}
+
+// answer 返回某种记录的应答，没有该类型的记录时返回 IsNotFound 的 *net.DNSError
+func (c *DNSClient) answer(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	in, server, e := c.Exchange(ctx, name, qtype)
+	if e != nil {
+		return nil, &net.DNSError{Err: e.Error(), Name: name, Server: server, IsTimeout: isTimeout(e)}
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, &net.DNSError{Err: dns.RcodeToString[in.Rcode], Name: name, Server: server, IsNotFound: in.Rcode == dns.RcodeNameError}
+	}
+	var answer []dns.RR
+	for _, rr := range in.Answer {
+		if rr.Header().Rrtype == qtype {
+			answer = append(answer, rr)
+		}
+	}
+	if len(answer) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+	}
+	return answer, nil
+}
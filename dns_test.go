@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDNS 在 127.0.0.1 上启动一个 UDP 的 dns.Server，返回它的地址
+func startDNS(t *testing.T, h dns.HandlerFunc) string {
+	pc, e := net.ListenPacket("udp", "127.0.0.1:0")
+	if e != nil {
+		t.Skipf("listen udp: %s", e)
+	}
+	var started = make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: h, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// rr 在 Handler 的 goroutine 中调用，不能用 t.Fatal
+func rr(s string) dns.RR {
+	r, e := dns.NewRR(s)
+	if e != nil {
+		panic(e)
+	}
+	return r
+}
+
+// zone 测试用的应答：
+// example.com 有 A 和 AAAA，www.example.com 在同一个应答里给出 CNAME 和地址，
+// cdn.example.com 只给出 CNAME，需要再查一次 edge.example.net，slow.example.com 不应答
+func zone() dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		var m = new(dns.Msg)
+		m.SetReply(r)
+		var q = r.Question[0]
+		switch q.Name {
+		case "example.com.":
+			if q.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, rr("example.com. 300 IN A 192.0.2.1"))
+			} else {
+				m.Answer = append(m.Answer, rr("example.com. 120 IN AAAA 2001:db8::1"))
+			}
+		case "www.example.com.":
+			m.Answer = append(m.Answer, rr("www.example.com. 600 IN CNAME example.com."))
+			if q.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, rr("example.com. 300 IN A 192.0.2.1"))
+			} else {
+				m.Answer = append(m.Answer, rr("example.com. 120 IN AAAA 2001:db8::1"))
+			}
+		case "cdn.example.com.":
+			m.Answer = append(m.Answer, rr("cdn.example.com. 600 IN CNAME edge.example.net."))
+		case "edge.example.net.":
+			if q.Qtype == dns.TypeAAAA {
+				m.Answer = append(m.Answer, rr("edge.example.net. 60 IN AAAA 2001:db8::2"))
+			}
+		case "slow.example.com.":
+			return
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func newTestDNSClient(t *testing.T) (*DNSClient, string) {
+	var addr = startDNS(t, zone())
+	c, e := newDNSClient([]string{addr}, "udp")
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Timeout = time.Millisecond * 300
+	return c, addr
+}
+
+func TestDNSClientLookup(t *testing.T) {
+	c, addr := newTestDNSClient(t)
+	records, e := c.Lookup(context.Background(), "example.com")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(records) != 2 || records[0].Type != "A" || records[1].Type != "AAAA" {
+		t.Fatalf("records %+v", records)
+	}
+	if records[0].Addrs[0] != "192.0.2.1" || records[0].TTL != 300 || records[0].Rcode != "NOERROR" || records[0].Server != addr {
+		t.Errorf("A %+v", records[0])
+	}
+	if records[1].Addrs[0] != "2001:db8::1" || records[1].TTL != 120 {
+		t.Errorf("AAAA %+v", records[1])
+	}
+	addrs, e := c.LookupHost(context.Background(), "example.com")
+	if e != nil || len(addrs) != 2 {
+		t.Errorf("LookupHost %v %v", addrs, e)
+	}
+}
+
+func TestDNSClientCNAME(t *testing.T) {
+	c, _ := newTestDNSClient(t)
+	records, e := c.Lookup(context.Background(), "www.example.com")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(records[0].CNAME) != 1 || records[0].CNAME[0] != "example.com" || records[0].Addrs[0] != "192.0.2.1" {
+		t.Errorf("A %+v", records[0])
+	}
+	//最小的 TTL
+	if records[1].TTL != 120 {
+		t.Errorf("AAAA ttl %d", records[1].TTL)
+	}
+
+	//应答里只有 CNAME 时继续查询目标，只有 AAAA 的 CDN 也能找到
+	records, e = c.Lookup(context.Background(), "cdn.example.com")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(records[0].Addrs) != 0 || records[0].Error != "" {
+		t.Errorf("A %+v", records[0])
+	}
+	if len(records[1].CNAME) != 1 || records[1].CNAME[0] != "edge.example.net" || records[1].Addrs[0] != "2001:db8::2" || records[1].TTL != 60 {
+		t.Errorf("AAAA %+v", records[1])
+	}
+}
+
+func TestDNSClientNXDOMAIN(t *testing.T) {
+	c, _ := newTestDNSClient(t)
+	records, e := c.Lookup(context.Background(), "nx.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(e, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("error %v", e)
+	}
+	if classify(e) != StatusNoRecord {
+		t.Errorf("status %v", classify(e))
+	}
+	if len(records) != 2 || records[0].Rcode != "NXDOMAIN" {
+		t.Errorf("records %+v", records)
+	}
+}
+
+func TestDNSClientTimeout(t *testing.T) {
+	c, _ := newTestDNSClient(t)
+	_, e := c.Lookup(context.Background(), "slow.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(e, &dnsErr) || !dnsErr.IsTimeout {
+		t.Fatalf("error %v", e)
+	}
+	if classify(e) != StatusDNSError {
+		t.Errorf("status %v", classify(e))
+	}
+}
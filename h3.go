@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// altSvcH3 从 Alt-Svc 头中找出 h3 的通告，返回通告的端口
+func altSvcH3(header http.Header) (string, bool) {
+	for _, v := range header.Values("Alt-Svc") {
+		for _, entry := range strings.Split(v, ",") {
+			var alt = strings.TrimSpace(strings.SplitN(entry, ";", 2)[0])
+			kv := strings.SplitN(alt, "=", 2)
+			if len(kv) != 2 || (kv[0] != "h3" && !strings.HasPrefix(kv[0], "h3-")) {
+				continue
+			}
+			_, port, e := net.SplitHostPort(strings.Trim(kv[1], `"`))
+			if e != nil || port == "" {
+				port = "443"
+			}
+			return port, true
+		}
+	}
+	return "", false
+}
+
+// checkH3 对指定的 ip 做一次 QUIC 握手
+// 握手成功为 StatusOK，没有通告 h3 且握手失败为 StatusUnknown，通告了但握手失败时给出失败原因
+func (pr *Prober) checkH3(ctx context.Context, site Site, ip string, header http.Header) ProbeResult {
+	port, advertised := altSvcH3(header)
+	if !advertised {
+		port = "443"
+	}
+	var probe = ProbeResult{SID: site.ID, IP: ip, Family: 6, Scheme: "h3"}
+	if net.ParseIP(ip).To4() != nil {
+		probe.Family = 4
+	}
+	//没有通告 h3 的站点大多不会回应 UDP，缩短等待时间
+	var timeout = pr.Timeout
+	if !advertised && timeout > time.Second*3 {
+		timeout = time.Second * 3
+	}
+	//在超时开始之前等待限速
+	if e := pr.Limit.WaitIP(ctx, ip); e != nil {
+		probe.Status, probe.Error = classify(e), e.Error()
+		return probe
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var tlsConf = &tls.Config{ServerName: site.Domain, NextProtos: []string{"h3"}}
+	if pr.TLSConfig != nil {
+		tlsConf.RootCAs = pr.TLSConfig.RootCAs
+	}
+	var start = pr.Now()
+	conn, e := pr.DialQUIC(ctx, net.JoinHostPort(ip, port), tlsConf, &quic.Config{HandshakeIdleTimeout: timeout})
+	probe.Latency = int64(pr.Now().Sub(start).Milliseconds())
+	if e != nil {
+		probe.Status, probe.Error = classify(e), e.Error()
+		if !advertised {
+			probe.Status = StatusUnknown
+		}
+		return probe
+	}
+	probe.Status, probe.Proto = StatusOK, "HTTP/3.0"
+	conn.CloseWithError(0, "")
+	return probe
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 任务的状态
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// maxJobAttempts 失败的任务最多尝试的次数
+const maxJobAttempts = 3
+
+// Job struct
+// 一次站点检测任务，保存在数据库中，重启后继续执行
+type Job struct {
+	ID        int64     `json:"id" xorm:"pk autoincr 'id'"`
+	SID       int       `json:"sid" xorm:"sid index"`
+	State     string    `json:"state" xorm:"state index"`
+	Attempts  int       `json:"attempts" xorm:"attempts"`
+	LastError string    `json:"last_error" xorm:"last_error text"`
+	Agent     string    `json:"agent" xorm:"agent index"` //为空表示本机执行，否则是领取任务的节点
+	Started   time.Time `json:"started" xorm:"started"`
+	Finished  time.Time `json:"finished" xorm:"finished"`
+	Created   time.Time `json:"created" xorm:"created"`
+	Updated   time.Time `json:"updated" xorm:"updated"`
+	Site      Site      `json:"-" xorm:"-"`
+}
+
+// enqueue 为站点创建任务并交给调度器，站点已有未完成的任务时返回 false
+// 先在调度器中占住站点再查询和插入，同时为一个站点 enqueue 时只有一个能创建任务
+func enqueue(site Site) bool {
+	if !sched.Reserve(site.ID) {
+		return false
+	}
+	has, e := db.Where("sid = ? and agent = '' and state in (?, ?)", site.ID, JobPending, JobRunning).Exist(&Job{})
+	if e != nil {
+		log.Printf("find job %d: %s", site.ID, e)
+	}
+	if e != nil || has {
+		sched.Release(site.ID)
+		return false
+	}
+	var job = Job{SID: site.ID, State: JobPending, Site: site}
+	if _, e := db.Insert(&job); e != nil {
+		log.Printf("insert job %d: %s", site.ID, e)
+		sched.Release(site.ID)
+		return false
+	}
+	return sched.SubmitReserved(job)
+}
+
+// resumeJobs 把数据库中等待执行的任务交给调度器，返回提交的数量
+func resumeJobs() int {
+	var jobs []Job
+	if e := db.Where("state = ? and agent = ''", JobPending).Asc("id").Limit(1000).Find(&jobs); e != nil {
+		log.Printf("find pending jobs: %s", e)
+		return 0
+	}
+	var n int
+	for _, job := range jobs {
+		if sched.Active(job.SID) {
+			continue
+		}
+		job.Site = Site{ID: job.SID}
+		has, e := db.Get(&job.Site)
+		if e != nil {
+			log.Printf("load site %d: %s", job.SID, e)
+			continue
+		}
+		if !has {
+			job.State, job.LastError = JobFailed, "site not found"
+			db.ID(job.ID).Cols("state", "last_error").Update(&job)
+			continue
+		}
+		if sched.Submit(job) {
+			n++
+		}
+	}
+	return n
+}
+
+// recoverJobs 上次退出时正在执行的任务重新执行
+func recoverJobs() {
+	n, e := db.Where("state = ? and agent = ''", JobRunning).Cols("state").Update(&Job{State: JobPending})
+	if e != nil {
+		log.Printf("recover running jobs: %s", e)
+		return
+	}
+	if n > 0 {
+		log.Printf("%d interrupted jobs recovered", n)
+	}
+}
+
+// runJob 标记任务开始后检测站点，由调度器调用
+func runJob(ctx context.Context, job *Job) checkResult {
+	job.State, job.Attempts, job.Started = JobRunning, job.Attempts+1, time.Now()
+	if _, e := db.ID(job.ID).Cols("state", "attempts", "started").Update(job); e != nil {
+		log.Printf("update job %d: %s", job.ID, e)
+	}
+	return checkSite(ctx, job.Site)
+}
+
+// finishJob 保存检测结果并更新任务状态，失败次数未到上限的任务回到等待状态
+// 不再重试的站点按连续失败推迟下次检测，否则 submitDue 每分钟都会重新提交它
+func finishJob(job Job, r checkResult) {
+	job.Finished = time.Now()
+	if r.Err == nil {
+		saveResult(r)
+		job.State, job.LastError = JobDone, ""
+	} else {
+		log.Printf("job %d site %d failed: %s", job.ID, job.SID, r.Err)
+		job.State, job.LastError = JobFailed, r.Err.Error()
+		if job.Attempts < maxJobAttempts {
+			job.State = JobPending
+		} else {
+			postpone(job.Site)
+		}
+	}
+	if _, e := db.ID(job.ID).Cols("state", "attempts", "last_error", "finished").Update(&job); e != nil {
+		log.Printf("update job %d: %s", job.ID, e)
+	}
+}
+
+// adminJobs 列出最近的任务和各状态的数量，可以用 state 参数筛选
+func adminJobs(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var state = req.URL.Query().Get("state")
+	var limit, _ = strconv.Atoi(req.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	var jobs = []Job{}
+	var s = db.Desc("id").Limit(limit, 0)
+	if state != "" {
+		s = s.Where("state = ?", state)
+	}
+	if e := s.Find(&jobs); e != nil {
+		panic(e)
+	}
+	var count = map[string]int64{}
+	for _, st := range []string{JobPending, JobRunning, JobDone, JobFailed} {
+		n, e := db.Where("state = ?", st).Count(&Job{})
+		if e != nil {
+			panic(e)
+		}
+		count[st] = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	msg, _ := json.Marshal(Er{Ret: "v", Data: map[string]interface{}{"count": count, "queued": sched.Len(), "jobs": jobs}})
+	w.Write(msg)
+}
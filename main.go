@@ -2,22 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 	"unicode/utf8"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/robfig/cron"
 	"github.com/urfave/negroni"
 	"github.com/xormplus/xorm"
 	"golang.org/x/crypto/acme/autocert"
@@ -27,8 +30,7 @@ import (
 )
 
 var (
-	task          = make(chan int, 10)
-	ch            = make(chan Site, 1)
+	sched         *Scheduler
 	logInfo       *log.Logger
 	logLoop       *log.Logger
 	logWarn       *log.Logger
@@ -36,30 +38,96 @@ var (
 	db            *xorm.Engine
 	scRefresh     = kingpin.Flag("refresh", "refresh program").Bool()
 	maxRoutineNum = kingpin.Flag("maxRoutineNum", "refresh status routine num").Default("10").Int()
+	jobTimeout    = kingpin.Flag("job-timeout", "time limit for checking one site").Default("5m").Duration()
+	scInterval    = kingpin.Flag("check-interval", "normal interval between two checks of a site").Default("24h").Duration()
+	scMinInterval = kingpin.Flag("check-min-interval", "interval after a status change or when the certificate expires soon").Default("1h").Duration()
+	scMaxInterval = kingpin.Flag("check-max-interval", "upper bound of the backoff for unreachable sites").Default("168h").Duration()
+	scJitter      = kingpin.Flag("check-jitter", "random fraction added to or removed from each interval").Default("0.2").Float64()
+	rateNet       = kingpin.Flag("rate-net", "connections per second to one /24 or /48, 0 for unlimited").Default("2").Float64()
+	rateDomain    = kingpin.Flag("rate-domain", "sites per second under one registrable domain, 0 for unlimited").Default("1").Float64()
+	rateBurst     = kingpin.Flag("rate-burst", "burst size of the rate limits").Default("4").Int()
 	port          = kingpin.Flag("port", "listen http port").Short('p').String()
 	scLogDir      = kingpin.Flag("log-dir", "log file path").Default("log").ExistingDir()
 	scLogFileName = kingpin.Flag("log-file-name", "log file name").Default("xping.log").String()
 	scinstall     = kingpin.Flag("install", "install program").Bool()
+	scRedirect    = kingpin.Flag("follow-redirects", "follow redirects and record the redirect chain per address family").Bool()
+	scCrawl       = kingpin.Flag("crawl", "parse the homepage and check third-party resource hosts for AAAA").Bool()
+	dnsServer     = kingpin.Flag("dns-server", "dns server used by checker, repeatable, default from /etc/resolv.conf").Strings()
+	dnsNet        = kingpin.Flag("dns-net", "dns query network, udp or tcp").Default("udp").Enum("udp", "tcp")
+	agentMode     = kingpin.Flag("agent", "run as a probe agent that pulls jobs from --server").Bool()
+	agentServer   = kingpin.Flag("server", "url of the central server in agent mode").String()
+	agentID       = kingpin.Flag("agent-id", "id of this agent").String()
+	agentToken    = kingpin.Flag("agent-token", "token of this agent").String()
+	agentLocation = kingpin.Flag("agent-location", "location shown for results of this agent").String()
+	agentTokens   = kingpin.Flag("agent-tokens", "id=token pairs accepted from agents, repeatable").Strings()
+	adminToken    = kingpin.Flag("admin-token", "static token accepted by the admin area").String()
+	scSessionKey  = kingpin.Flag("session-key", "key signing admin session cookies, random at each start if empty").String()
+	addAdmin      = kingpin.Flag("add-admin", "add an admin or reset its password, read from the first line of stdin").String()
 )
 
 //Site struct
-//V6 V4 开头的属性，默认值为1 2代表支持
+//V6 V4 开头的属性见 ProbeStatus，默认值为1 2代表支持
 type Site struct {
-	ID      int       `json:"id" xorm:"pk autoincr 'id'"`
-	Domain  string    `json:"domain" xorm:"domain"`
-	Desc    string    `json:"desc" xorm:"desc"`
-	IPv6    string    `json:"ipv6" xorm:"ipv6"`
-	IPv4    string    `json:"ipv4" xorm:"ipv4"`
-	V6hp    int       `json:"v6hp" xorm:"v6hp"` //检测是否有v6 http
-	V4hp    int       `json:"v4hp" xorm:"v4hp"` //检测是否有v4 http
-	V6hs    int       `json:"v6hs" xorm:"v6hs"` //检测是否有v6 https
-	V4hs    int       `json:"v4hs" xorm:"v4hs"` //检测是否有v4 https
-	V6h2    int       `json:"v6h2" xorm:"v6h2"` //检测是否有v6 htt2
-	V4h2    int       `json:"v4h2" xorm:"v4h2"` //检测是否有v4 htt2
-	CETime  time.Time `json:"cetime" xorm:"cetime"`
-	V6time  time.Time `json:"v6time" xorm:"v6time"`
-	Created time.Time `json:"created" xorm:"created"`
-	Updated time.Time `json:"updated" xorm:"updated"`
+	ID           int           `json:"id" xorm:"pk autoincr 'id'"`
+	Domain       string        `json:"domain" xorm:"domain"`
+	Desc         string        `json:"desc" xorm:"desc"`
+	SkipVariant  bool          `json:"skip_variant" xorm:"skip_variant"` //不检测 www 与主域名的另一种写法
+	IPv6         string        `json:"ipv6" xorm:"ipv6"`
+	IPv4         string        `json:"ipv4" xorm:"ipv4"`
+	V6hp         ProbeStatus   `json:"v6hp" xorm:"v6hp"`                   //检测是否有v6 http
+	V4hp         ProbeStatus   `json:"v4hp" xorm:"v4hp"`                   //检测是否有v4 http
+	V6hs         ProbeStatus   `json:"v6hs" xorm:"v6hs"`                   //检测是否有v6 https
+	V4hs         ProbeStatus   `json:"v4hs" xorm:"v4hs"`                   //检测是否有v4 https
+	V6h2         ProbeStatus   `json:"v6h2" xorm:"v6h2"`                   //检测是否有v6 htt2
+	V4h2         ProbeStatus   `json:"v4h2" xorm:"v4h2"`                   //检测是否有v4 htt2
+	V6h3         ProbeStatus   `json:"v6h3" xorm:"v6h3"`                   //检测是否有v6 http3
+	V4h3         ProbeStatus   `json:"v4h3" xorm:"v4h3"`                   //检测是否有v4 http3
+	V6ns         ProbeStatus   `json:"v6ns" xorm:"v6ns"`                   //检测 NS 是否有 AAAA
+	V6nsq        ProbeStatus   `json:"v6nsq" xorm:"v6nsq"`                 //检测 NS 能否通过 v6 应答
+	V6mx         ProbeStatus   `json:"v6mx" xorm:"v6mx"`                   //检测 MX 是否有 AAAA
+	V6smtp       ProbeStatus   `json:"v6smtp" xorm:"v6smtp"`               //检测 MX 能否通过 v6 收到 SMTP banner
+	V6rd         ProbeStatus   `json:"v6rd" xorm:"v6rd"`                   //检测 v6 跳转链是否全程支持 v6
+	V4hsts       ProbeStatus   `json:"v4hsts" xorm:"v4hsts"`               //检测 v4 https 是否有 HSTS
+	V6hsts       ProbeStatus   `json:"v6hsts" xorm:"v6hsts"`               //检测 v6 https 是否有 HSTS
+	Parity       ParityVerdict `json:"parity" xorm:"parity"`               //v4 v6 返回的内容是否一致
+	SubHosts     int           `json:"subhosts" xorm:"subhosts"`           //首页引用的第三方域名数
+	V6Full       int           `json:"v6full" xorm:"v6full"`               //有 AAAA 记录的第三方域名百分比
+	V4TTFB       int64         `json:"v4ttfb" xorm:"v4ttfb"`               //v4 最快的首字节时间，毫秒
+	V6TTFB       int64         `json:"v6ttfb" xorm:"v6ttfb"`               //v6 最快的首字节时间，毫秒
+	V6Penalty    float64       `json:"v6penalty" xorm:"v6penalty index"`   //V6TTFB 是 V4TTFB 的几倍，按此排序 v6 性能差的站点
+	CertMismatch bool          `json:"cert_mismatch" xorm:"cert_mismatch"` //v4 v6 返回的证书不一致
+	CETime       time.Time     `json:"cetime" xorm:"cetime"`               //v4 v6 中最早的证书过期时间
+	V4CETime     time.Time     `json:"v4cetime" xorm:"v4cetime"`           //v4 地址中最早的证书过期时间
+	V6CETime     time.Time     `json:"v6cetime" xorm:"v6cetime"`           //v6 地址中最早的证书过期时间
+	V6time       time.Time     `json:"v6time" xorm:"v6time"`
+	NextCheck    time.Time     `json:"next_check" xorm:"next_check index"`      //下次检测的时间，见 Schedule
+	Fails        int           `json:"fails" xorm:"fails"`                      //连续无法访问的次数
+	Addrs        []Addr        `json:"addrs" xorm:"addrs text"`                 //每个解析地址各自的检测结果
+	DNS          []DNSRecord   `json:"dns" xorm:"dns text"`                     //A AAAA 查询的细节
+	Hosts        []HostCheck   `json:"hosts" xorm:"hosts text"`                 //NS MX 主机的检测结果
+	V6Hops       []Hop         `json:"v6hops" xorm:"v6hops text"`               //只用 v6 访问时的跳转链
+	V4Hops       []Hop         `json:"v4hops" xorm:"v4hops text"`               //只用 v4 访问时的跳转链
+	ParityDetail Parity        `json:"parity_detail" xorm:"parity_detail text"` //内容对比的细节
+	Blockers     []string      `json:"blockers" xorm:"blockers text"`           //没有 AAAA 记录的第三方域名
+	Certs        []CertInfo    `json:"certs" xorm:"certs text"`                 //每个地址返回的证书
+	Security     []Security    `json:"security" xorm:"security text"`           //每个地址的 HSTS 安全头 ALPN
+	Variants     []Variant     `json:"variants" xorm:"variants text"`           //www 与主域名各自的检测结果
+	Targets      []Target      `json:"targets" xorm:"-"`                        //站点配置的检测目标，检测前从 target 表读取
+	Created      time.Time     `json:"created" xorm:"created"`
+	Updated      time.Time     `json:"updated" xorm:"updated"`
+}
+
+// Addr struct
+// 单个解析地址的检测结果，Site 上的 V6 V4 属性由它们汇总：
+// 全部地址都支持为 StatusOK，部分地址支持为 StatusPartial
+type Addr struct {
+	IP     string      `json:"ip"`
+	Family int         `json:"family"`
+	Hp     ProbeStatus `json:"hp"`
+	Hs     ProbeStatus `json:"hs"`
+	H2     ProbeStatus `json:"h2"`
+	H3     ProbeStatus `json:"h3"`
+	CETime time.Time   `json:"cetime"` //该地址返回的证书过期时间
 }
 
 //Lable struct
@@ -73,6 +141,34 @@ type Lable struct {
 	Updated  time.Time `json:"updated" xorm:"updated"`
 }
 
+// ProbeResult struct
+// 每次检测每个地址、每种协议记录一条，Site 只保留最近一次的结果
+type ProbeResult struct {
+	ID          int64       `json:"id" xorm:"pk autoincr 'id'"`
+	SID         int         `json:"sid" xorm:"sid index"`
+	TID         int64       `json:"tid" xorm:"tid"`           //检测的是站点配置的目标时为目标的 id
+	Agent       string      `json:"agent" xorm:"agent index"` //探测节点的 id，为空表示本机
+	IP          string      `json:"ip" xorm:"ip"`
+	Family      int         `json:"family" xorm:"family"` //4 或 6
+	Scheme      string      `json:"scheme" xorm:"scheme"` //http https h3 ns mx，解析失败时为 dns
+	Status      ProbeStatus `json:"status" xorm:"status"`
+	Proto       string      `json:"proto" xorm:"proto"`
+	CETime      time.Time   `json:"cetime" xorm:"cetime"`
+	Error       string      `json:"error" xorm:"error"`
+	Latency     int64       `json:"latency" xorm:"latency"`           //毫秒
+	DNSTime     int64       `json:"dns_time" xorm:"dns_time"`         //解析耗时，毫秒
+	ConnectTime int64       `json:"connect_time" xorm:"connect_time"` //TCP 建立连接耗时，毫秒
+	TLSTime     int64       `json:"tls_time" xorm:"tls_time"`         //TLS 握手耗时，毫秒
+	TTFB        int64       `json:"ttfb" xorm:"ttfb"`                 //从发起请求到收到首字节，毫秒
+	Created     time.Time   `json:"created" xorm:"created index"`
+}
+
+type checkResult struct {
+	Site   Site
+	Probes []ProbeResult
+	Err    error //检测超时或中途出错，此时不保存结果
+}
+
 // Er struct
 type Er struct {
 	Ret   string      `json:"ret"`
@@ -88,7 +184,9 @@ type school struct {
 	Classify string `json:"classify"`
 }
 
-func init() {
+// setup 读取命令行参数，连接数据库并启动调度器
+// 不放在 init 中，否则 go test 时 kingpin 会把 -test.* 参数当作错误
+func setup() {
 	kingpin.Parse()
 	var e error
 	params := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8&parseTime=true", "root", "qwerty", "mysql:3306", "v6sc")
@@ -96,32 +194,48 @@ func init() {
 	if e != nil {
 		panic(e)
 	}
-	task = make(chan int, *maxRoutineNum)
-	go func() {
-		for {
-			select {
-			case s := <-ch:
-				db.ID(s.ID).Update(&s)
-			}
-		}
-	}()
+	prober.Redirect = *scRedirect
+	prober.Crawl = *scCrawl
+	if c, e := newDNSClient(*dnsServer, *dnsNet); e != nil {
+		log.Printf("dns client: %s, fallback to system resolver", e)
+	} else {
+		prober.Resolver = c
+	}
+	schedule.Interval, schedule.Min, schedule.Max, schedule.Jitter = *scInterval, *scMinInterval, *scMaxInterval, *scJitter
+	var limit = newRateLimiter(*rateNet, *rateDomain, *rateBurst)
+	prober.Limit = limit
+	sched = newScheduler(*maxRoutineNum, *jobTimeout, runJob, finishJob)
+	sched.Limit = limit
+	sched.Start()
+	initSessionKey()
 }
 
+// install 创建缺少的表，已有的表补上新增的字段和索引，启动时也会调用，旧的数据库不需要手动迁移
 func install() error {
 	if e := db.Ping(); e != nil {
 		return e
 	}
-	return db.CreateTables(&Site{}, &Lable{})
+	return db.Sync2(&Site{}, &Lable{}, &ProbeResult{}, &Target{}, &Job{}, &Vantage{}, &User{}, &Submission{}, &Block{})
 }
 
 func main() {
+	setup()
 	logFile, e := os.OpenFile(fmt.Sprintf("%s/%s", *scLogDir, *scLogFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if e != nil {
 		log.Fatalln("打开日志文件失败：", e)
 	}
 
 	if *scinstall {
-		install()
+		if e := install(); e != nil {
+			log.Fatalln("建表失败：", e)
+		}
+		os.Exit(0)
+	}
+
+	if *addAdmin != "" {
+		if e := addUser(*addAdmin, os.Stdin); e != nil {
+			log.Fatalln("添加管理员失败：", e)
+		}
 		os.Exit(0)
 	}
 
@@ -134,39 +248,49 @@ func main() {
 	httpLog.ALogger = log.New(io.MultiWriter(os.Stdout, logFile), "[https] ", 0)
 	httpLog.SetFormat("{{.StartTime}} {{.Hostname}} {{.Duration}} [{{.Method}} {{.Request.Proto}} {{.Status}} {{.Path}}] {{.Request.RemoteAddr}} {{.Request.UserAgent}}")
 
+	if *agentMode {
+		if *agentServer == "" || *agentID == "" {
+			log.Fatalln("agent mode requires --server and --agent-id")
+		}
+		runAgent(&Agent{Server: *agentServer, ID: *agentID, Token: *agentToken, Location: *agentLocation, Client: &http.Client{Timeout: time.Minute}})
+		os.Exit(0)
+	}
+
+	if e := install(); e != nil {
+		log.Fatalln("同步表结构失败：", e)
+	}
+	recoverJobs()
 	if *scRefresh {
+		resumeJobs()
 		refresh()
-		taskRecordT := time.NewTicker(time.Second * 10)
-		for _ = range taskRecordT.C {
-			fmt.Println(len(task))
-			if len(task) == 0 {
+		//失败的任务会回到等待状态，直到没有可以重试的任务
+		for {
+			sched.Wait()
+			if resumeJobs() == 0 {
 				break
 			}
 		}
+		sched.Stop()
 		os.Exit(0)
 	}
 
 	go func() {
-		c := cron.New()
-		c.AddFunc("0 0 3 * * *", func() {
-			refresh()
-		})
-		c.Start()
+		//收到退出信号后等正在检测的站点保存完再退出
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		log.Printf("shutting down, %d queued jobs left pending", sched.Len())
+		sched.Stop()
+		os.Exit(0)
 	}()
-	mux := httprouter.New()
+
+	go dueLoop(time.Minute)
+	mux := newRouter()
 	mux.PanicHandler = func(w http.ResponseWriter, r *http.Request, v interface{}) {
 		w.WriteHeader(http.StatusInternalServerError)
 		logError.Println(v)
 	}
-	mux.GET("/", indexHTML)
-	mux.GET("/renewal", renewal)
-	mux.GET("/index", indexHTML)
-	mux.GET("/testsite", testsite)
-	mux.GET("/justSupport", justSupport)
-	mux.GET("/searchsite", searchsite)
-	mux.GET("/addsite", addsite)
-	mux.GET("/cityuniversitydetail", cityuniversitydetail)
-	mux.ServeFiles("/static/*filepath", http.Dir("./static"))
+	registerRoutes(mux)
 	if *port != "" {
 		fmt.Printf("http://127.0.0.1:%s\n", *port)
 		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", *port), mux))
@@ -190,6 +314,44 @@ func main() {
 	ss.ListenAndServeTLS("", "")
 }
 
+// registerRoutes 注册全部路由，测试中用它检查 /api/ 的路由与 apiRoutes 是否一致
+func registerRoutes(mux *router) {
+	mux.GET("/", indexHTML)
+	mux.GET("/renewal", renewal)
+	mux.GET("/index", indexHTML)
+	mux.GET("/testsite", testsite)
+	mux.GET("/justSupport", justSupport)
+	mux.GET("/searchsite", searchsite)
+	mux.GET("/addsite", addsite)
+	mux.GET("/cityuniversitydetail", cityuniversitydetail)
+	mux.GET("/siteinfo", siteinfo)
+	mux.GET("/targets", targets)
+	mux.POST("/addtarget", adminAuth(addtarget))
+	mux.POST("/edittarget", adminAuth(edittarget))
+	mux.POST("/deltarget", adminAuth(deltarget))
+	mux.GET("/admin", adminHTML)
+	mux.POST("/admin/login", adminLogin)
+	mux.POST("/admin/logout", adminLogout)
+	mux.GET("/admin/jobs", adminAuth(adminJobs))
+	mux.POST("/admin/site/edit", adminAuth(adminEditSite))
+	mux.POST("/admin/site/delete", adminAuth(adminDeleteSite))
+	mux.POST("/admin/site/merge", adminAuth(adminMergeSite))
+	mux.POST("/admin/site/relabel", adminAuth(adminRelabel))
+	mux.POST("/admin/submission/approve", adminAuth(adminApprove))
+	mux.POST("/admin/submission/reject", adminAuth(adminReject))
+	mux.POST("/admin/block/add", adminAuth(adminAddBlock))
+	mux.POST("/admin/block/delete", adminAuth(adminDelBlock))
+	mux.POST("/agent/jobs", agentAuth(agentJobs))
+	mux.POST("/agent/results", agentAuth(agentResults))
+	mux.GET("/vantage", vantage)
+	mux.GET("/api/v1/sites", apiSites)
+	mux.GET("/api/v1/sites/:id", apiSite)
+	mux.GET("/api/v1/labels", apiLabels)
+	mux.GET("/api/v1/stats", apiStats)
+	mux.GET("/api/openapi.json", openapi)
+	mux.ServeFiles("/static/*filepath", http.Dir("./static"))
+}
+
 func refresh() {
 	log.Printf("refresh start\n")
 	var sites []Site
@@ -197,8 +359,7 @@ func refresh() {
 		panic(err)
 	}
 	for _, site := range sites {
-		task <- 1
-		go checkDomain(site)
+		enqueue(site)
 	}
 }
 
@@ -209,8 +370,12 @@ func justSupport(w http.ResponseWriter, req *http.Request, _ httprouter.Params)
 		return
 	}
 	log.Printf("Method %s RemoteAddr %s User-Agent %s URL %s Behavior Load More Just Support%s\n", req.Method, req.RemoteAddr, req.UserAgent(), req.URL.String(), n)
-	var latestSupportV6 []Site
-	if err := db.Where("v6time is not null").Desc("v6time").Limit(20, (b-1)*20).Find(&latestSupportV6); err != nil {
+	var offset = (b - 1) * 20
+	if offset < 0 {
+		offset = 0
+	}
+	latestSupportV6, _, err := siteQuery{SupportV6: true, Sort: "-v6time", Offset: offset, Limit: 20}.Find()
+	if err != nil {
 		panic(err)
 	}
 
@@ -219,19 +384,21 @@ func justSupport(w http.ResponseWriter, req *http.Request, _ httprouter.Params)
 		<td class="align-middle">{{$v.Domain}}</td>
 		<td class="align-middle">{{$v.Desc}}</td>
 		<td class="align-middle">{{$v.IPv4}}</td>
-		<td>{{if eq $v.V4hp 2}}<button type="button" class="btn btn-outline-success btn-sm">已支持</button>{{else}}<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>{{end}}</td>
+		<td>{{checkSupport $v 4 "http"}}</td>
 		<td>{{checkCertificate $v 4}}</td>
-		<td>{{if eq $v.V4h2 2}}<button type="button" class="btn btn-outline-success btn-sm">已支持</button>{{else}}<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>{{end}}</td>
+		<td>{{checkSupport $v 4 "h2"}}</td>
+		<td>{{checkSupport $v 4 "h3"}}</td>
 		<td class="align-middle">{{$v.IPv6}}</td>
-		<td>{{if eq $v.V6hp 2}}<button type="button" class="btn btn-outline-success btn-sm">已支持</button>{{else}}<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>{{end}}</td>
+		<td>{{checkSupport $v 6 "http"}}{{checkParity $v}}</td>
 		<td>{{checkCertificate $v 6}}</td>
-		<td>{{if eq $v.V6h2 2}}<button type="button" class="btn btn-outline-success btn-sm">已支持</button>{{else}}<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>{{end}}</td>
+		<td>{{checkSupport $v 6 "h2"}}</td>
+		<td>{{checkSupport $v 6 "h3"}}</td>
 		<td class="align-middle">{{$v.Created.Format "2006-01-02 15:04"}}</td>
 		<td class="align-middle">{{$v.Updated.Format "2006-01-02 15:04"}}</td>
 		<td class="align-middle"><a href="javascript:renewal({{$v.ID}})">更新</a></td>
 	</tr>
 	{{end}}`
-	t, _ := template.New("dom").Funcs(template.FuncMap{"checkCertificate": checkCertificate}).Parse(dom)
+	t, _ := template.New("dom").Funcs(template.FuncMap{"checkCertificate": checkCertificate, "checkSupport": checkSupport, "checkParity": checkParity}).Parse(dom)
 	t.Execute(w, map[string]interface{}{"latestSupportV6": latestSupportV6})
 }
 
@@ -240,8 +407,7 @@ func searchsite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	if domain == "" {
 		return
 	}
-	var res []Site
-	err := db.Where("domain like ?", "%"+domain+"%").Desc("id").Limit(20, 0).Find(&res)
+	res, _, err := siteQuery{Domain: domain, Sort: "-id", Limit: 20}.Find()
 	if err != nil {
 		return
 	}
@@ -250,48 +416,37 @@ func searchsite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		<td class="align-middle">{{$v.Domain}}</td>
 		<td class="align-middle">{{$v.Desc}}</td>
 		<td class="align-middle">{{$v.IPv4}}</td>
-		<td> {{if eq $v.V4hp 2}}<button type="button" class="btn btn-outline-success btn-sm">已支持</button>{{else}}<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>{{end}}</td>
-		<td>{{checkCertificate $v 4}}</td>
-		<td> {{if eq $v.V4h2 2}}<button type="button" class="btn btn-outline-success btn-sm">已支持</button>{{else}}<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>{{end}}</td>
+		<td>{{checkSupport $v 4 "http"}}</td>
+		<td>{{checkCertificate $v 4}}{{checkHSTS $v 4}}</td>
+		<td>{{checkSupport $v 4 "h2"}}</td>
+		<td>{{checkSupport $v 4 "h3"}}</td>
 		<td class="align-middle">{{viewIPv6 $v.IPv6}}</td>
-		<td> {{if eq $v.V6hp 2}}<button type="button" class="btn btn-outline-success btn-sm">已支持</button>{{else}}<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>{{end}}</td>
-		<td>{{checkCertificate $v 6}}</td>
-		<td> {{if eq $v.V6h2 2}}<button type="button" class="btn btn-outline-success btn-sm">已支持</button>{{else}}<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>{{end}}</td>
+		<td>{{checkSupport $v 6 "http"}}{{checkParity $v}}</td>
+		<td>{{checkCertificate $v 6}}{{checkHSTS $v 6}}</td>
+		<td>{{checkSupport $v 6 "h2"}}</td>
+		<td>{{checkSupport $v 6 "h3"}}</td>
+		<td>{{checkCrawl $v}}</td>
 		<td class="align-middle">{{$v.Created.Format "2006-01-02 15:04"}}</td>
 		<td class="align-middle">{{$v.Updated.Format "2006-01-02 15:04"}}</td>
-		<td class="align-middle"><a href="javascript:renewal({{$v.ID}})">更新</a></td>
+		<td class="align-middle"><a href="javascript:renewal({{$v.ID}})">更新</a> <a href="javascript:targets({{$v.ID}})">目标</a> <a href="javascript:vantage({{$v.ID}})">各节点</a></td>
 	</tr>
 	{{end}}`
 	t, _ := template.New("dom").Funcs(template.FuncMap{
 		"checkCertificate": checkCertificate,
+		"checkSupport":     checkSupport,
+		"checkParity":      checkParity,
+		"checkCrawl":       checkCrawl,
+		"checkHSTS":        checkHSTS,
 		"viewIPv6":         viewIPv6,
 	}).Parse(dom)
 	t.Execute(w, map[string]interface{}{"res": res})
 }
 
 func testsite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	var domain = req.URL.Query().Get("domain")
-	wSite := &Site{Domain: domain}
-	res, ge := db.Get(wSite)
-	if ge != nil {
-		panic(ge)
-	}
-	if res {
+	var domain = normalizeDomain(req.URL.Query().Get("domain"))
+	if prompt := checkSubmission(req.Context(), domain, remoteIP(req)); prompt != "" {
 		w.WriteHeader(http.StatusOK)
-		msg, _ := json.Marshal(Er{Ret: "e", Msg: "此域名已有记录，你可以再搜索中找到它"})
-		w.Write(msg)
-		return
-	}
-	if ip := net.ParseIP(domain); ip != nil {
-		w.WriteHeader(http.StatusOK)
-		msg, _ := json.Marshal(Er{Ret: "e", Msg: "不能是IP"})
-		w.Write(msg)
-		return
-	}
-	ns, err := net.LookupHost(domain)
-	if err != nil || len(ns) < 1 {
-		w.WriteHeader(http.StatusOK)
-		msg, _ := json.Marshal(Er{Ret: "e", Msg: "没有dns记录"})
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: prompt})
 		w.Write(msg)
 		return
 	}
@@ -300,21 +455,32 @@ func testsite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	w.Write(msg)
 }
 
-func addsite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	var domain = req.URL.Query().Get("domain")
-	var desc = req.URL.Query().Get("desc")
-	wSite := &Site{Domain: domain}
-	//先查库里有没有
-	res, ge := db.Get(wSite)
+// siteinfo 返回一个站点最近一次检测的全部结果，包括 HSTS、安全头和 ALPN
+func siteinfo(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var site = Site{Domain: req.URL.Query().Get("domain")}
+	site.ID, _ = strconv.Atoi(req.URL.Query().Get("id"))
+	w.Header().Set("Content-Type", "application/json")
+	if site.ID == 0 && site.Domain == "" {
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: "缺少参数"})
+		w.Write(msg)
+		return
+	}
+	res, ge := db.Get(&site)
 	if ge != nil {
 		panic(ge)
 	}
-	if res {
-		w.WriteHeader(http.StatusOK)
-		msg, _ := json.Marshal(Er{Ret: "e", Msg: "此域名已有记录，你可以再搜索中找到它"})
+	if !res {
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: "没有此域名的记录"})
 		w.Write(msg)
 		return
 	}
+	msg, _ := json.Marshal(Er{Ret: "v", Data: site})
+	w.Write(msg)
+}
+
+func addsite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var domain = normalizeDomain(req.URL.Query().Get("domain"))
+	var desc = req.URL.Query().Get("desc")
 	descLen := utf8.RuneCountInString(desc)
 	if descLen < 2 {
 		w.WriteHeader(http.StatusOK)
@@ -328,56 +494,69 @@ func addsite(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		w.Write(msg)
 		return
 	}
-	if ip := net.ParseIP(domain); ip != nil {
+	//重复、屏蔽和解析的检查与 testsite 相同
+	if prompt := checkSubmission(req.Context(), domain, remoteIP(req)); prompt != "" {
 		w.WriteHeader(http.StatusOK)
-		msg, _ := json.Marshal(Er{Ret: "e", Msg: "不能是IP"})
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: prompt})
 		w.Write(msg)
 		return
 	}
-	ns, err := net.LookupHost(domain)
-	if err != nil || len(ns) < 1 {
-		w.WriteHeader(http.StatusOK)
-		msg, _ := json.Marshal(Er{Ret: "e", Msg: "没有dns记录"})
-		w.Write(msg)
-		return
+	//管理员在 /admin 通过后才加入 site 表
+	var sub = Submission{
+		Domain:      domain,
+		Desc:        desc,
+		SkipVariant: req.URL.Query().Get("variant") == "0",
+		State:       SubmissionPending,
+		IP:          remoteIP(req),
+		UserAgent:   req.UserAgent(),
+	}
+	if _, err := db.Insert(&sub); err != nil {
+		panic(err)
 	}
-	var site Site
-	site.Domain = domain
+	log.Printf("submission %d %s from %s User-Agent %s", sub.ID, sub.Domain, sub.IP, sub.UserAgent)
+	w.WriteHeader(http.StatusOK)
+	msg, _ := json.Marshal(Er{Ret: "v", Msg: "已提交，审核通过后显示"})
+	w.Write(msg)
+}
+
+// createSite 加入 site 表并开始检测，解析失败时地址留空，由检测补上
+func createSite(ctx context.Context, domain, desc string, skipVariant bool) (Site, error) {
+	var site = Site{Domain: domain, Desc: desc, SkipVariant: skipVariant}
+	ns, _ := prober.Resolver.LookupHost(ctx, domain)
+	var v4, v6 []string
 	for _, s := range ns {
 		if net.ParseIP(s).To4() != nil {
-			site.IPv4 = s
+			v4 = append(v4, s)
 		} else {
-			site.IPv6 = s
+			v6 = append(v6, s)
 		}
 	}
-	site.Desc = desc
-	_, err = db.Insert(&site)
-	if err != nil {
-		panic(err)
+	site.IPv4 = strings.Join(v4, ",")
+	site.IPv6 = strings.Join(v6, ",")
+	if _, e := db.Insert(&site); e != nil {
+		return site, e
 	}
-
-	go func() {
-		task <- 1
-		checkDomain(site)
-	}()
-	w.WriteHeader(http.StatusOK)
-	msg, _ := json.Marshal(Er{Ret: "v", Msg: "添加完毕"})
-	w.Write(msg)
+	enqueue(site)
+	return site, nil
 }
 
 func indexHTML(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	var latestDomain []Site
-	var latestSupportV6 []Site
-	var willExpire []Site
-
-	if err := db.Where("v6time is not null").Desc("v6time").Limit(20, 0).Find(&latestSupportV6); err != nil {
+	latestSupportV6, _, err := siteQuery{SupportV6: true, Sort: "-v6time", Limit: 20}.Find()
+	if err != nil {
+		panic(err)
+	}
+	willExpire, _, err := siteQuery{Expire: 30, Sort: "cetime"}.Find()
+	if err != nil {
 		panic(err)
 	}
-	if err := db.Where("cetime is not null and cetime < ?", time.Now().UTC().Add(time.Hour*time.Duration(30*24))).Asc("cetime").Find(&willExpire); err != nil {
+
+	slowV6, _, err := siteQuery{MinPenalty: 1, Sort: "-v6penalty", Limit: 20}.Find()
+	if err != nil {
 		panic(err)
 	}
 
-	if err := db.Desc("created").Limit(20, 0).Find(&latestDomain); err != nil {
+	latestDomain, _, err := siteQuery{Sort: "-created", Limit: 20}.Find()
+	if err != nil {
 		panic(err)
 	}
 
@@ -404,13 +583,13 @@ func indexHTML(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		if university.IPv6 != "" {
 			supportIpv6Count++
 		}
-		if university.V6hs == 2 {
+		if university.V6hs == StatusOK {
 			supportIpv6HttpsCount++
 		}
-		if university.V6hp == 2 {
+		if university.V6hp == StatusOK {
 			supportIpv6HttpCount++
 		}
-		if university.V6h2 == 2 {
+		if university.V6h2 == StatusOK {
 			supportIpv6Http2Count++
 		}
 		universityClassify[university.Lable.Lable] = append(universityClassify[university.Lable.Lable], university.Site)
@@ -441,11 +620,11 @@ func indexHTML(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		supportV6Count int64
 	)
 
-	siteCount, e := db.Table("site").Count()
+	siteCount, e := siteQuery{}.Count()
 	if e != nil {
 		panic(e)
 	}
-	supportV6Count, e = db.Table("site").Where("IPv6 != ''").Count()
+	supportV6Count, e = siteQuery{Family: 6}.Count()
 	if e != nil {
 		panic(e)
 	}
@@ -458,13 +637,14 @@ func indexHTML(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	} else {
 		siteStat["supportV6Scale"] = 0
 	}
-	t, _ := template.New("index.html").Funcs(template.FuncMap{"checkCertificate": checkCertificate, "viewIPv6": viewIPv6, "universityCount": universityCount}).ParseFiles("views/index.html")
+	t, _ := template.New("index.html").Funcs(template.FuncMap{"checkCertificate": checkCertificate, "checkSupport": checkSupport, "checkParity": checkParity, "checkLatency": checkLatency, "certExpiry": certExpiry, "viewIPv6": viewIPv6, "universityCount": universityCount}).ParseFiles("views/index.html")
 
 	t.Execute(w, map[string]interface{}{
 		"siteStat":           siteStat,
 		"universityStat":     universityStat,
 		"latestDomain":       latestDomain,
 		"willExpire":         willExpire,
+		"slowV6":             slowV6,
 		"latestSupportV6":    latestSupportV6,
 		"universityDetails":  universityDetails,
 		"universityClassify": universityClassify,
@@ -479,10 +659,7 @@ func renewal(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		panic(ge)
 	}
 	if res {
-		go func() {
-			task <- 1
-			checkDomain(site)
-		}()
+		enqueue(site)
 		w.WriteHeader(http.StatusOK)
 		msg, _ := json.Marshal(Er{Ret: "v", Msg: "已经加入列队"})
 		w.Write(msg)
@@ -501,28 +678,151 @@ func viewIPv6(ip string) string {
 	}
 	return fmt.Sprintf("<span data-toggle='tooltip' data-placement='top' data-html='true' title='%s'>%s</span>", ip, newIP)
 }
+func checkSupport(site Site, v int, kind string) string {
+	var p = site.status(v, kind)
+	var pick = func(a Addr) ProbeStatus { return a.H2 }
+	switch kind {
+	case "http":
+		pick = func(a Addr) ProbeStatus { return a.Hp }
+	case "https":
+		pick = func(a Addr) ProbeStatus { return a.Hs }
+	case "h3":
+		pick = func(a Addr) ProbeStatus { return a.H3 }
+	}
+	if kind == "http" && v == 6 && p.Supported() && site.V6rd == StatusRedirectLost {
+		return fmt.Sprintf(`<button type="button" class="btn btn-outline-warning btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">跳转后不支持</button>`, hopTitle(site.V6Hops))
+	}
+	switch p {
+	case StatusOK:
+		return `<button type="button" class="btn btn-outline-success btn-sm">已支持</button>`
+	case StatusPartial:
+		return fmt.Sprintf(`<button type="button" class="btn btn-outline-warning btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">部分支持</button>`, addrTitle(site, v, p, pick))
+	case StatusUnknown, 0:
+		return `<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>`
+	}
+	return fmt.Sprintf(`<button type="button" class="btn btn-outline-danger btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">不支持</button>`, addrTitle(site, v, p, pick))
+}
+
+// 列出某个协议下每个地址的检测结果，没有地址时给出整体的失败原因
+func addrTitle(site Site, v int, p ProbeStatus, pick func(a Addr) ProbeStatus) string {
+	var lines []string
+	for _, a := range site.Addrs {
+		if a.Family != v {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", a.IP, pick(a)))
+	}
+	if len(lines) == 0 {
+		return p.String()
+	}
+	return strings.Join(lines, "<br>")
+}
+
+// checkParity 在 v6 http 旁边标出 v4 v6 内容不一致的站点
+func checkParity(site Site) string {
+	if site.Parity != ParitySimilar && site.Parity != ParityDiffer {
+		return ""
+	}
+	var d = site.ParityDetail
+	var title = tooltip(
+		d.URL,
+		fmt.Sprintf("v4: %d %s %dB", d.V4Status, d.V4Title, d.V4Length),
+		fmt.Sprintf("v6: %d %s %dB", d.V6Status, d.V6Title, d.V6Length),
+		fmt.Sprintf("相似度 %d%%", d.Score),
+	)
+	var class = "btn-outline-warning"
+	if site.Parity == ParityDiffer {
+		class = "btn-outline-danger"
+	}
+	return fmt.Sprintf(` <button type="button" class="btn %s btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">%s</button>`, class, title, site.Parity)
+}
+
+// 列出跳转链的每一跳
+func hopTitle(hops []Hop) string {
+	var lines []string
+	for _, h := range hops {
+		if h.Error != "" {
+			lines = append(lines, fmt.Sprintf("%s %s", h.URL, h.Error))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d %s [%s]", h.Status, h.URL, h.IP))
+		}
+	}
+	return tooltip(lines...)
+}
+
+// tooltip 生成 data-html 提示框的 title 属性值，每行一段文字
+// 每行先转义成 HTML 再用 <br> 连接，整体再转义一次作为属性值：
+// 浏览器解码属性后 Bootstrap 把结果当作 HTML 插入，远程站点返回的内容只能显示为文字
+func tooltip(lines ...string) string {
+	var escaped = make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = html.EscapeString(line)
+	}
+	return html.EscapeString(strings.Join(escaped, "<br>"))
+}
+
+// cetime 某个协议族的证书过期时间，之前的记录没有分开保存时使用 CETime
+func (site Site) cetime(v int) time.Time {
+	var t = site.V4CETime
+	if v == 6 {
+		t = site.V6CETime
+	}
+	if t.IsZero() {
+		return site.CETime
+	}
+	return t
+}
+
+// certExpiry v4 v6 的证书过期时间不同时分别显示
+func certExpiry(site Site) string {
+	const layout = "2006-01-02 15:04"
+	if site.V4CETime.IsZero() || site.V6CETime.IsZero() || site.V4CETime.Equal(site.V6CETime) {
+		return site.CETime.Format(layout)
+	}
+	return fmt.Sprintf("v4 %s<br>v6 %s", site.V4CETime.Format(layout), site.V6CETime.Format(layout))
+}
+
+func (site Site) status(v int, kind string) ProbeStatus {
+	switch {
+	case kind == "http" && v == 4:
+		return site.V4hp
+	case kind == "http":
+		return site.V6hp
+	case kind == "https" && v == 4:
+		return site.V4hs
+	case kind == "https":
+		return site.V6hs
+	case kind == "h3" && v == 4:
+		return site.V4h3
+	case kind == "h3":
+		return site.V6h3
+	case v == 4:
+		return site.V4h2
+	}
+	return site.V6h2
+}
+
 func checkCertificate(site Site, v int) string {
-	var p int
-	if v == 4 {
-		p = site.V4hs
-	} else {
-		p = site.V6hs
+	var p = site.status(v, "https")
+	if p != StatusOK {
+		return checkSupport(site, v, "https")
 	}
-	if p != 2 {
-		return `<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>`
+	if site.CertMismatch {
+		return fmt.Sprintf(`<button type="button" class="btn btn-outline-warning btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">证书不一致</button>`, certTitle(site, v))
 	}
-	if site.CETime.IsZero() {
+	var ce = site.cetime(v)
+	if ce.IsZero() {
 		return `<button type="button" class="btn btn-outline-success btn-sm">已支持</button>`
 	}
-	if site.CETime.Before(time.Now()) {
+	if ce.Before(time.Now()) {
 		var title = "证书今天刚过期"
-		if int(time.Now().Sub(site.CETime).Hours())/24 > 0 {
-			title = fmt.Sprintf("证书已在%d天前过期", int(time.Now().Sub(site.CETime).Hours())/24)
+		if int(time.Now().Sub(ce).Hours())/24 > 0 {
+			title = fmt.Sprintf("证书已在%d天前过期", int(time.Now().Sub(ce).Hours())/24)
 		}
 		return fmt.Sprintf(`<button type="button" class="btn btn-danger btn-sm" data-toggle="tooltip" data-placement="top" title="%s">已过期</button>`, title)
 	}
-	if site.CETime.Before(time.Now().AddDate(0, 1, 0)) {
-		return fmt.Sprintf(`<button type="button" class="btn btn-outline-warning btn-sm" data-toggle="tooltip" data-placement="top" title="%d天后证书过期">已支持</button>`, int(site.CETime.Sub(time.Now()).Hours())/24)
+	if ce.Before(time.Now().AddDate(0, 1, 0)) {
+		return fmt.Sprintf(`<button type="button" class="btn btn-outline-warning btn-sm" data-toggle="tooltip" data-placement="top" title="%d天后证书过期">已支持</button>`, int(ce.Sub(time.Now()).Hours())/24)
 	}
 	return `<button type="button" class="btn btn-outline-success btn-sm">已支持</button>`
 }
@@ -540,13 +840,13 @@ func universityCount(x string, y []Site) string {
 		if un.IPv6 != "" {
 			ipv6P++
 		}
-		if un.V6hs == 2 {
+		if un.V6hs == StatusOK {
 			v6hsP++
 		}
-		if un.V6h2 == 2 {
+		if un.V6h2 == StatusOK {
 			v6h2P++
 		}
-		if un.V6hp == 2 {
+		if un.V6hp == StatusOK {
 			v6hpP++
 		}
 	}
@@ -584,9 +884,8 @@ func universityCount(x string, y []Site) string {
 func cityuniversitydetail(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	var city = req.URL.Query().Get("city")
 	log.Printf("Method %s RemoteAddr %s User-Agent %s Behavior Load %s's University\n", req.Method, req.RemoteAddr, req.UserAgent(), city)
-	var cityUniversityDetails []Site
-
-	if err := db.Table("lable").Join("INNER", "site", "site.id=lable.sid").Where("lable.classify=? and lable.lable=?", "university", city).Desc("site.v6time").Find(&cityUniversityDetails); err != nil {
+	cityUniversityDetails, _, err := siteQuery{Classify: "university", Label: city, Sort: "-v6time"}.Find()
+	if err != nil {
 		panic(err)
 	}
 	var dom = `<tr class='tag-{{.city}} cityUniversityDetails' style='background: rgb(249, 249, 182)'>
@@ -600,20 +899,22 @@ func cityuniversitydetail(w http.ResponseWriter, req *http.Request, _ httprouter
 				<th scope='col'>IPv6 http</th>
 				<th scope='col'>IPv6 https</th>
 				<th scope='col'>IPv6 h2</th>
+				<th scope='col'>www / 主域名</th>
 			</tr>
 			</thead>
 			{{range $k,$v := .cityUniversityDetails}}
 			<tr>
 				<td>{{$v.Desc}}（<a href='http://{{$v.Domain}}'>{{$v.Domain}}</a>）</td>
 				<td>{{if $v.IPv6}}{{.IPv6}}{{end}}</td>
-				<td>{{if eq $v.V6hp 2}}<button type='button' class='btn btn-outline-success btn-sm'>已支持</button>{{else}}<button type='button' class='btn btn-outline-danger btn-sm'>不支持</button>{{end}}</td>
+				<td>{{checkSupport $v 6 "http"}}{{checkParity $v}}</td>
 				<td>{{checkCertificate $v 6}}</td>
-				<td>{{if eq $v.V6h2 2}}<button type='button' class='btn btn-outline-success btn-sm'>已支持</button>{{else}}<button type='button' class='btn btn-outline-danger btn-sm'>不支持</button>{{end}}</td>
+				<td>{{checkSupport $v 6 "h2"}}</td>
+				<td>{{checkVariant $v}}</td>
 			</tr>
 			{{end}}
 		</table>
 	</td></tr>`
 
-	t, _ := template.New("dom").Funcs(template.FuncMap{"checkCertificate": checkCertificate}).Parse(dom)
+	t, _ := template.New("dom").Funcs(template.FuncMap{"checkCertificate": checkCertificate, "checkSupport": checkSupport, "checkParity": checkParity, "checkVariant": checkVariant}).Parse(dom)
 	t.Execute(w, map[string]interface{}{"cityUniversityDetails": cityUniversityDetails, "city": city})
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 屏蔽的类型
+const (
+	BlockDomain = "domain"
+	BlockIP     = "ip"
+)
+
+// maxPendingPerIP 同一个地址最多有多少个待审核的提交
+const maxPendingPerIP = 5
+
+// rejectCooldown 被拒绝的域名多久之内不能再次提交
+const rejectCooldown = 30 * 24 * time.Hour
+
+// Block struct
+// 屏蔽的域名或提交者地址，域名同时屏蔽其子域名，地址可以是 CIDR
+type Block struct {
+	ID      int       `json:"id" xorm:"pk autoincr 'id'"`
+	Kind    string    `json:"kind" xorm:"kind"` //domain 或 ip
+	Value   string    `json:"value" xorm:"value index"`
+	Reason  string    `json:"reason" xorm:"reason"`
+	Creator string    `json:"creator" xorm:"creator"` //添加的管理员
+	Created time.Time `json:"created" xorm:"created"`
+}
+
+// match 域名或地址是否被屏蔽
+func (b Block) match(domain, ip string) bool {
+	switch b.Kind {
+	case BlockDomain:
+		return domain == b.Value || strings.HasSuffix(domain, "."+b.Value)
+	case BlockIP:
+		if _, n, e := net.ParseCIDR(b.Value); e == nil {
+			return n.Contains(net.ParseIP(ip))
+		}
+		return net.ParseIP(b.Value).Equal(net.ParseIP(ip))
+	}
+	return false
+}
+
+func blocked(domain, ip string) bool {
+	var blocks []Block
+	if e := db.Find(&blocks); e != nil {
+		panic(e)
+	}
+	for _, b := range blocks {
+		if b.match(domain, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDomain 去掉空白和末尾的点，转为小写
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// remoteIP 请求的来源地址，不含端口
+func remoteIP(req *http.Request) string {
+	if host, _, e := net.SplitHostPort(req.RemoteAddr); e == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// checkDomain 检查域名的写法，返回给用户的提示，合法时返回空
+func checkDomain(domain string) string {
+	if domain == "" {
+		return "域名不能为空"
+	}
+	if net.ParseIP(domain) != nil {
+		return "不能是IP"
+	}
+	return ""
+}
+
+// checkSubmission testsite 和 addsite 共用的检查，返回给用户的提示，可以提交时返回空
+func checkSubmission(ctx context.Context, domain, ip string) string {
+	if prompt := checkDomain(domain); prompt != "" {
+		return prompt
+	}
+	if blocked(domain, ip) {
+		log.Printf("blocked submission %s from %s", domain, ip)
+		return "此域名不能提交"
+	}
+	var variants = variantDomains(domain)
+	has, e := db.In("domain", variants).Exist(&Site{})
+	if e != nil {
+		panic(e)
+	}
+	if has {
+		return "此域名已有记录，你可以再搜索中找到它"
+	}
+	if has, e = db.In("domain", variants).And("state = ?", SubmissionPending).Exist(&Submission{}); e != nil {
+		panic(e)
+	}
+	if has {
+		return "此域名已经提交，正在等待审核"
+	}
+	if has, e = db.In("domain", variants).And("state = ? and updated > ?", SubmissionRejected, time.Now().Add(-rejectCooldown)).Exist(&Submission{}); e != nil {
+		panic(e)
+	}
+	if has {
+		return "此域名不能提交"
+	}
+	n, e := db.Where("ip = ? and state = ?", ip, SubmissionPending).Count(&Submission{})
+	if e != nil {
+		panic(e)
+	}
+	if n >= maxPendingPerIP {
+		return "你提交的网站还在等待审核，请稍后再提交"
+	}
+	ns, e := prober.Resolver.LookupHost(ctx, domain)
+	if e != nil || len(ns) < 1 {
+		return "没有dns记录"
+	}
+	return ""
+}
+
+// addBlock 添加屏蔽，并拒绝与之匹配的待审核提交
+func addBlock(b Block) error {
+	if _, e := db.Insert(&b); e != nil {
+		return e
+	}
+	var pending []Submission
+	if e := db.Where("state = ?", SubmissionPending).Find(&pending); e != nil {
+		return e
+	}
+	for _, sub := range pending {
+		if !b.match(sub.Domain, sub.IP) {
+			continue
+		}
+		sub.State, sub.Reason, sub.Reviewer = SubmissionRejected, "blocked: "+b.Value, b.Creator
+		if _, e := db.ID(sub.ID).Cols("state", "reason", "reviewer").Update(&sub); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// adminReject 拒绝提交，block 为 domain 或 ip 时同时屏蔽该域名或提交者地址
+func adminReject(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var id, _ = strconv.Atoi(req.FormValue("id"))
+	var sub = Submission{ID: id}
+	has, e := db.Get(&sub)
+	if e != nil {
+		panic(e)
+	}
+	if id <= 0 || !has || sub.State != SubmissionPending {
+		adminReply(w, Er{Ret: "e", Msg: "没有待审核的记录"})
+		return
+	}
+	sub.State, sub.Reason, sub.Reviewer = SubmissionRejected, req.FormValue("reason"), adminUser(req)
+	if _, e := db.ID(sub.ID).Cols("state", "reason", "reviewer").Update(&sub); e != nil {
+		panic(e)
+	}
+	switch req.FormValue("block") {
+	case BlockDomain:
+		e = addBlock(Block{Kind: BlockDomain, Value: sub.Domain, Reason: sub.Reason, Creator: sub.Reviewer})
+	case BlockIP:
+		e = addBlock(Block{Kind: BlockIP, Value: sub.IP, Reason: sub.Reason, Creator: sub.Reviewer})
+	}
+	if e != nil {
+		panic(e)
+	}
+	log.Printf("admin %s rejected submission %d %s from %s: %s", sub.Reviewer, sub.ID, sub.Domain, sub.IP, sub.Reason)
+	adminReply(w, Er{Ret: "v", Msg: "已拒绝", Data: sub})
+}
+
+// adminAddBlock 屏蔽一个域名或者地址
+func adminAddBlock(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var b = Block{Kind: req.FormValue("kind"), Value: strings.TrimSpace(req.FormValue("value")), Reason: req.FormValue("reason"), Creator: adminUser(req)}
+	switch b.Kind {
+	case BlockDomain:
+		b.Value = normalizeDomain(b.Value)
+		if b.Value == "" || net.ParseIP(b.Value) != nil {
+			adminReply(w, Er{Ret: "e", Msg: "域名不正确"})
+			return
+		}
+	case BlockIP:
+		if _, _, e := net.ParseCIDR(b.Value); e != nil && net.ParseIP(b.Value) == nil {
+			adminReply(w, Er{Ret: "e", Msg: "地址不正确"})
+			return
+		}
+	default:
+		adminReply(w, Er{Ret: "e", Msg: "类型应为 domain 或 ip"})
+		return
+	}
+	if e := addBlock(b); e != nil {
+		panic(e)
+	}
+	log.Printf("admin %s blocked %s %s: %s", b.Creator, b.Kind, b.Value, b.Reason)
+	adminReply(w, Er{Ret: "v", Msg: "已屏蔽"})
+}
+
+func adminDelBlock(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var id, _ = strconv.Atoi(req.FormValue("id"))
+	if id <= 0 {
+		adminReply(w, Er{Ret: "e", Msg: "没有这个记录"})
+		return
+	}
+	if _, e := db.ID(id).Delete(&Block{}); e != nil {
+		panic(e)
+	}
+	log.Printf("admin %s removed block %d", adminUser(req), id)
+	adminReply(w, Er{Ret: "v", Msg: "已删除"})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HostCheck struct
+// NS 或 MX 主机的 IPv6 检测结果
+type HostCheck struct {
+	Kind   string      `json:"kind"` //ns 或 mx
+	Host   string      `json:"host"`
+	IPv6   []string    `json:"ipv6"`
+	Status ProbeStatus `json:"status"` //通过 IPv6 能否得到 DNS 应答或 SMTP banner
+}
+
+// infraResolver 能查询 NS MX 的解析器，*net.Resolver 和 DNSClient 都满足
+type infraResolver interface {
+	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// checkInfra 检测站点所在区域的 NS 和 MX 是否有 AAAA，以及能否通过 IPv6 提供服务
+func (pr *Prober) checkInfra(ctx context.Context, site *Site) []ProbeResult {
+	site.Hosts = nil
+	site.V6ns, site.V6nsq, site.V6mx, site.V6smtp = StatusUnknown, StatusUnknown, StatusUnknown, StatusUnknown
+	ir, ok := pr.Resolver.(infraResolver)
+	if !ok {
+		return nil
+	}
+	var probes []ProbeResult
+	zone, ns, err := findZone(ctx, ir, site.Domain)
+	if err != nil {
+		site.V6ns, site.V6nsq = classify(err), classify(err)
+	} else {
+		var hosts []string
+		for _, n := range ns {
+			hosts = append(hosts, n.Host)
+		}
+		var p []ProbeResult
+		site.V6ns, site.V6nsq, p = pr.checkHosts(ctx, site, "ns", hosts, func(ctx context.Context, ip string) error {
+			return pr.dnsOverIPv6(ctx, ip, zone)
+		})
+		probes = append(probes, p...)
+	}
+
+	if zone == "" {
+		zone = site.Domain
+	}
+	mx, err := ir.LookupMX(ctx, zone)
+	if err != nil {
+		site.V6mx, site.V6smtp = classify(err), classify(err)
+		return probes
+	}
+	var hosts []string
+	for _, m := range mx {
+		//"." 表示该域名不收邮件
+		if m.Host != "." {
+			hosts = append(hosts, m.Host)
+		}
+	}
+	var p []ProbeResult
+	site.V6mx, site.V6smtp, p = pr.checkHosts(ctx, site, "mx", hosts, pr.smtpBanner)
+	return append(probes, p...)
+}
+
+// checkHosts 返回这些主机 AAAA 的汇总结果和通过 IPv6 提供服务的汇总结果
+func (pr *Prober) checkHosts(ctx context.Context, site *Site, kind string, hosts []string, serve func(ctx context.Context, ip string) error) (ProbeStatus, ProbeStatus, []ProbeResult) {
+	var probes []ProbeResult
+	var aaaa, served []ProbeStatus
+	for _, host := range hosts {
+		var check = HostCheck{Kind: kind, Host: strings.TrimSuffix(host, "."), Status: StatusNoRecord}
+		ips, e := pr.Resolver.LookupHost(ctx, host)
+		if e != nil {
+			check.Status = classify(e)
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip).To4() == nil {
+				check.IPv6 = append(check.IPv6, ip)
+			}
+		}
+		var statuses []ProbeStatus
+		for _, ip := range check.IPv6 {
+			var probe = ProbeResult{SID: site.ID, IP: ip, Family: 6, Scheme: kind}
+			//和 http 请求一样按地址段限速，等待的时间不算在 Latency 中
+			e := pr.Limit.WaitIP(ctx, ip)
+			if e == nil {
+				var start = pr.Now()
+				e = serve(ctx, ip)
+				probe.Latency = int64(pr.Now().Sub(start) / time.Millisecond)
+			}
+			probe.Status = classify(e)
+			if e != nil {
+				probe.Error = e.Error()
+			}
+			statuses = append(statuses, probe.Status)
+			probes = append(probes, probe)
+		}
+		if len(check.IPv6) > 0 {
+			check.Status = combine(statuses)
+			aaaa = append(aaaa, StatusOK)
+		} else {
+			aaaa = append(aaaa, StatusNoRecord)
+		}
+		served = append(served, check.Status)
+		site.Hosts = append(site.Hosts, check)
+	}
+	return combine(aaaa), combine(served), probes
+}
+
+// findZone 从域名本身开始逐级向上查找 NS，返回找到 NS 的区域
+func findZone(ctx context.Context, ir infraResolver, domain string) (string, []*net.NS, error) {
+	var labels = strings.Split(strings.TrimSuffix(domain, "."), ".")
+	var lastErr error
+	for i := 0; i < len(labels)-1; i++ {
+		var zone = strings.Join(labels[i:], ".")
+		ns, e := ir.LookupNS(ctx, zone)
+		if e == nil && len(ns) > 0 {
+			return zone, ns, nil
+		}
+		var dnsErr *net.DNSError
+		if e != nil && !(errors.As(e, &dnsErr) && dnsErr.IsNotFound) {
+			return "", nil, e
+		}
+		lastErr = e
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	return "", nil, lastErr
+}
+
+// dnsOverIPv6 通过 IPv6 向权威服务器查询区域的 SOA
+func (pr *Prober) dnsOverIPv6(ctx context.Context, ip string, zone string) error {
+	ctx, cancel := context.WithTimeout(ctx, pr.Timeout)
+	defer cancel()
+	conn, e := pr.Dialer.DialContext(ctx, "udp6", net.JoinHostPort(ip, "53"))
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	var co = &dns.Conn{Conn: conn}
+	var m = new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	if e := co.WriteMsg(m); e != nil {
+		return e
+	}
+	in, e := co.ReadMsg()
+	if e != nil {
+		return e
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dns rcode %s: %w", dns.RcodeToString[in.Rcode], errRefused)
+	}
+	return nil
+}
+
+// smtpBanner 通过 IPv6 连接 25 端口，要求收到 220 开头的 banner
+func (pr *Prober) smtpBanner(ctx context.Context, ip string) error {
+	ctx, cancel := context.WithTimeout(ctx, pr.Timeout)
+	defer cancel()
+	conn, e := pr.Dialer.DialContext(ctx, "tcp6", net.JoinHostPort(ip, "25"))
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	line, e := bufio.NewReader(conn).ReadString('\n')
+	if e != nil {
+		return e
+	}
+	if !strings.HasPrefix(line, "220") {
+		return fmt.Errorf("smtp banner %q: %w", strings.TrimSpace(line), errRefused)
+	}
+	fmt.Fprint(conn, "QUIT\r\n")
+	return nil
+}
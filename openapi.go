@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiRoute 一个 JSON 接口，/api/openapi.json 由 apiRoutes 生成
+type apiRoute struct {
+	Method  string
+	Path    string //httprouter 的写法，路径参数为 :name
+	Summary string
+	Params  []apiParam
+	Data    interface{} //应答中 data 的类型，nil 表示不使用 Er 包装
+}
+
+// apiParam 接口参数，In 为 query 或 path
+type apiParam struct {
+	Name     string
+	In       string
+	Type     string //string 或 integer
+	Desc     string
+	Enum     []interface{}
+	Required bool
+}
+
+// apiRoutes 所有 /api/ 下的接口，新增接口时要同时加在这里，否则 TestRoutesMatchSpec 失败
+var apiRoutes = []apiRoute{
+	{
+		Method:  "GET",
+		Path:    "/api/v1/sites",
+		Summary: "站点列表，按 cursor 翻页",
+		Params: []apiParam{
+			{Name: "domain", In: "query", Type: "string", Desc: "域名包含"},
+			{Name: "family", In: "query", Type: "integer", Desc: "只要有该协议族地址的站点", Enum: []interface{}{4, 6}},
+			{Name: "support", In: "query", Type: "string", Desc: "与 family 一起使用，只要该协议族支持此协议的站点", Enum: []interface{}{"http", "https", "h2", "h3"}},
+			{Name: "label", In: "query", Type: "string", Desc: "标签"},
+			{Name: "classify", In: "query", Type: "string", Desc: "标签分类，如 university"},
+			{Name: "expire", In: "query", Type: "integer", Desc: "证书在多少天内过期，包括已经过期的"},
+			{Name: "sort", In: "query", Type: "string", Desc: "排序字段，前面加 - 表示倒序，默认 -id", Enum: sortEnum()},
+			{Name: "cursor", In: "query", Type: "string", Desc: "上一页返回的 next"},
+			{Name: "limit", In: "query", Type: "integer", Desc: "每页数量，1 到 100，默认 20"},
+		},
+		Data: sitePage{},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/v1/sites/:id",
+		Summary: "一个站点及其标签和检测目标",
+		Params:  []apiParam{{Name: "id", In: "path", Type: "integer", Required: true}},
+		Data:    siteDetail{},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/v1/labels",
+		Summary: "所有标签及其站点数",
+		Params:  []apiParam{{Name: "classify", In: "query", Type: "string", Desc: "标签分类"}},
+		Data:    []labelCount{},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/v1/stats",
+		Summary: "站点总数，以及每个协议族有地址和支持各协议的站点数",
+		Params: []apiParam{
+			{Name: "classify", In: "query", Type: "string", Desc: "标签分类"},
+			{Name: "label", In: "query", Type: "string", Desc: "标签"},
+		},
+		Data: map[string]int64{},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/openapi.json",
+		Summary: "本文档",
+	},
+}
+
+func sortEnum() []interface{} {
+	var fields []string
+	for f := range sortFields {
+		fields = append(fields, f, "-"+f)
+	}
+	sort.Strings(fields)
+	var enum []interface{}
+	for _, f := range fields {
+		enum = append(enum, f)
+	}
+	return enum
+}
+
+// router 记录注册的路由，用于在测试中与 apiRoutes 对照
+type router struct {
+	*httprouter.Router
+	routes []string //METHOD path
+}
+
+func newRouter() *router {
+	return &router{Router: httprouter.New()}
+}
+
+// GET 与 httprouter 一致，同时记录路由
+func (r *router) GET(path string, h httprouter.Handle) {
+	r.routes = append(r.routes, "GET "+path)
+	r.Router.GET(path, h)
+}
+
+// POST 与 httprouter 一致，同时记录路由
+func (r *router) POST(path string, h httprouter.Handle) {
+	r.routes = append(r.routes, "POST "+path)
+	r.Router.POST(path, h)
+}
+
+// checkSpec 检查 mux 上 /api/ 下的路由和 apiRoutes 是否一一对应，路径参数是否都有说明
+func checkSpec(routes []string) error {
+	var registered = make(map[string]bool)
+	for _, r := range routes {
+		registered[r] = true
+	}
+	var spec = make(map[string]bool)
+	for _, r := range apiRoutes {
+		var key = r.Method + " " + r.Path
+		if spec[key] {
+			return fmt.Errorf("openapi: %s is listed twice", key)
+		}
+		spec[key] = true
+		if !registered[key] {
+			return fmt.Errorf("openapi: %s is not registered on the router", key)
+		}
+		var params = make(map[string]bool)
+		for _, p := range r.Params {
+			if p.In == "path" {
+				params[p.Name] = true
+			}
+		}
+		for _, seg := range strings.Split(r.Path, "/") {
+			if strings.HasPrefix(seg, ":") && !params[seg[1:]] {
+				return fmt.Errorf("openapi: %s has no path parameter %s", key, seg[1:])
+			}
+			delete(params, strings.TrimPrefix(seg, ":"))
+		}
+		for p := range params {
+			return fmt.Errorf("openapi: %s documents unknown path parameter %s", key, p)
+		}
+	}
+	for _, r := range routes {
+		if strings.HasPrefix(strings.SplitN(r, " ", 2)[1], "/api/") && !spec[r] {
+			return fmt.Errorf("openapi: %s is missing from apiRoutes", r)
+		}
+	}
+	return nil
+}
+
+// specPath 把 :name 换成 OpenAPI 的 {name}
+func specPath(path string) string {
+	var segs = strings.Split(path, "/")
+	for i, seg := range segs {
+		if strings.HasPrefix(seg, ":") {
+			segs[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// openAPI 由 apiRoutes 和应答类型的 json tag 生成 OpenAPI 3 文档
+func openAPI() map[string]interface{} {
+	var schemas = map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"ret":   map[string]interface{}{"type": "string", "enum": []string{"e"}},
+				"msg":   map[string]interface{}{"type": "string"},
+				"data":  map[string]interface{}{"nullable": true},
+				"param": map[string]interface{}{"type": "string"},
+			},
+		},
+	}
+	var errorRef = map[string]interface{}{
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+			},
+		},
+	}
+	var paths = make(map[string]interface{})
+	for _, r := range apiRoutes {
+		var params []interface{}
+		for _, p := range r.Params {
+			var schema = map[string]interface{}{"type": p.Type}
+			if p.Enum != nil {
+				schema["enum"] = p.Enum
+			}
+			params = append(params, map[string]interface{}{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Desc,
+				"required":    p.Required,
+				"schema":      schema,
+			})
+		}
+		var ok = map[string]interface{}{"type": "object"}
+		if r.Data != nil {
+			ok = map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"ret":   map[string]interface{}{"type": "string", "enum": []string{"v"}},
+					"msg":   map[string]interface{}{"type": "string"},
+					"data":  schemaOf(reflect.TypeOf(r.Data), schemas),
+					"param": map[string]interface{}{"type": "string"},
+				},
+			}
+		}
+		var op = map[string]interface{}{
+			"operationId": strings.ToLower(r.Method) + strings.NewReplacer("/", "_", ":", "", ".", "_").Replace(r.Path),
+			"summary":     r.Summary,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": ok},
+					},
+				},
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+			op["responses"].(map[string]interface{})["400"] = map[string]interface{}{"description": "参数错误", "content": errorRef["content"]}
+		}
+		if strings.Contains(r.Path, ":") {
+			op["responses"].(map[string]interface{})["404"] = map[string]interface{}{"description": "不存在", "content": errorRef["content"]}
+		}
+		var path = specPath(r.Path)
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path].(map[string]interface{})[strings.ToLower(r.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "v6sc",
+			"description": "网站 IPv6 支持情况",
+			"version":     "1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf 按 encoding/json 的规则生成类型的 schema，结构体放进 schemas 并返回引用
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return map[string]interface{}{}
+	}
+	var ref = map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	if _, ok := schemas[t.Name()]; ok {
+		return ref
+	}
+	//先占位，结构体引用自身时不会无限递归
+	schemas[t.Name()] = nil
+	var props = make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		var f = t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		var name = f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		props[name] = schemaOf(f.Type, schemas)
+	}
+	schemas[t.Name()] = map[string]interface{}{"type": "object", "properties": props}
+	return ref
+}
+
+// openapi /api/openapi.json
+func openapi(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	msg, _ := json.Marshal(openAPI())
+	w.Write(msg)
+}
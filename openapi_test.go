@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutesMatchSpec(t *testing.T) {
+	var mux = newRouter()
+	registerRoutes(mux)
+	if e := checkSpec(mux.routes); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestCheckSpec(t *testing.T) {
+	var mux = newRouter()
+	registerRoutes(mux)
+	//没有写进 apiRoutes 的接口
+	if e := checkSpec(append(mux.routes, "GET /api/v1/unknown")); e == nil || !strings.Contains(e.Error(), "missing") {
+		t.Errorf("unlisted route: %v", e)
+	}
+	//apiRoutes 中有但没有注册的接口
+	var routes []string
+	for _, r := range mux.routes {
+		if r != "GET /api/v1/stats" {
+			routes = append(routes, r)
+		}
+	}
+	if e := checkSpec(routes); e == nil || !strings.Contains(e.Error(), "not registered") {
+		t.Errorf("unregistered route: %v", e)
+	}
+}
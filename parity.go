@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// ParityVerdict v4 与 v6 返回内容的对比结论
+type ParityVerdict int
+
+const (
+	ParityUnknown ParityVerdict = iota //没有比较，至少一个协议族无法访问
+	ParitySame                         //内容完全相同
+	ParitySimilar                      //内容相近，比如页面中带有时间戳
+	ParityDiffer                       //内容不同，比如 v6 返回了默认页面
+)
+
+var parityText = map[ParityVerdict]string{
+	ParityUnknown: "未比较",
+	ParitySame:    "内容一致",
+	ParitySimilar: "内容相近",
+	ParityDiffer:  "内容不同",
+}
+
+func (p ParityVerdict) String() string {
+	return parityText[p]
+}
+
+// maxBody 比较内容时最多读取的字节数
+const maxBody = 1 << 20
+
+// Parity struct
+// 分别通过 v4 和 v6 GET 同一个地址得到的内容摘要
+type Parity struct {
+	URL      string `json:"url"`
+	V4Status int    `json:"v4status"`
+	V6Status int    `json:"v6status"`
+	V4Title  string `json:"v4title"`
+	V6Title  string `json:"v6title"`
+	V4Length int    `json:"v4length"`
+	V6Length int    `json:"v6length"`
+	V4Hash   string `json:"v4hash"`
+	V6Hash   string `json:"v6hash"`
+	Score    int    `json:"score"` //0-100 的相似度
+}
+
+var titleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// parity 用每个协议族第一个能访问的地址 GET 首页并比较，返回 v6 取得的内容供后续使用
+func (pr *Prober) parity(ctx context.Context, site *Site) []byte {
+	site.Parity, site.ParityDetail = ParityUnknown, Parity{}
+	var scheme = "http://"
+	if site.V4hs.Supported() && site.V6hs.Supported() {
+		scheme = "https://"
+	}
+	var ips = map[int]string{}
+	for _, a := range site.Addrs {
+		var ok = a.Hp == StatusOK
+		if scheme == "https://" {
+			ok = a.Hs == StatusOK
+		}
+		if _, found := ips[a.Family]; ok && !found {
+			ips[a.Family] = a.IP
+		}
+	}
+	if ips[4] == "" || ips[6] == "" {
+		return nil
+	}
+	var d = Parity{URL: fmt.Sprintf("%s%s/", scheme, site.Domain)}
+	resp4, body4, e := pr.fetch(ctx, d.URL, ips[4])
+	if e != nil {
+		return nil
+	}
+	resp6, body6, e := pr.fetch(ctx, d.URL, ips[6])
+	if e != nil {
+		return nil
+	}
+	d.V4Status, d.V6Status = resp4.StatusCode, resp6.StatusCode
+	d.V4Title, d.V6Title = pageTitle(body4), pageTitle(body6)
+	d.V4Length, d.V6Length = len(body4), len(body6)
+	d.V4Hash, d.V6Hash = bodyHash(body4), bodyHash(body6)
+	d.Score = similarity(body4, body6)
+
+	switch {
+	case d.V4Status != d.V6Status:
+		site.Parity = ParityDiffer
+	case d.V4Hash == d.V6Hash:
+		site.Parity = ParitySame
+	case d.V4Title == d.V6Title && d.Score >= 80:
+		site.Parity = ParitySimilar
+	default:
+		site.Parity = ParityDiffer
+	}
+	site.ParityDetail = d
+	return body6
+}
+
+func pageTitle(body []byte) string {
+	m := titleRe.FindSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return strings.TrimSpace(html.UnescapeString(string(m[1])))
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// similarity 按词集合计算 Jaccard 相似度
+func similarity(a, b []byte) int {
+	var wa, wb = map[string]bool{}, map[string]bool{}
+	for _, w := range strings.Fields(string(a)) {
+		wa[w] = true
+	}
+	for _, w := range strings.Fields(string(b)) {
+		wb[w] = true
+	}
+	if len(wa) == 0 && len(wb) == 0 {
+		return 100
+	}
+	var both int
+	for w := range wa {
+		if wb[w] {
+			both++
+		}
+	}
+	return both * 100 / (len(wa) + len(wb) - both)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// fakeResolver 按域名返回固定的地址，没有的域名返回不存在
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := f[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// fakeDialer 把 ip:port 换成本地测试服务器的地址，没有对应时连接一个已关闭的端口
+type fakeDialer struct {
+	addrs  map[string]string
+	closed string
+}
+
+func (f fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var target, ok = f.addrs[address]
+	if !ok {
+		target = f.closed
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", target)
+}
+
+// probeEnv 127.0.0.1 和 ::1 上各有一个 http 和一个 https 服务器
+type probeEnv struct {
+	http4, https4, http6, https6 string
+	garbage6                     string //在 ::1 上接受连接后返回非 TLS 的数据
+	closed                       string
+	pool                         *x509.CertPool
+}
+
+func listen(t *testing.T, network, address string) net.Listener {
+	l, e := net.Listen(network, address)
+	if e != nil {
+		t.Skipf("listen %s: %s", address, e)
+	}
+	return l
+}
+
+func newProbeEnv(t *testing.T) probeEnv {
+	var h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>hello</title></head><body>hello ipv6</body></html>"))
+	})
+	var env probeEnv
+	var start = func(network, address string, tls bool) string {
+		s := httptest.NewUnstartedServer(h)
+		s.Listener = listen(t, network, address)
+		if tls {
+			s.EnableHTTP2 = true
+			s.StartTLS()
+			env.pool = x509.NewCertPool()
+			env.pool.AddCert(s.Certificate())
+		} else {
+			s.Start()
+		}
+		t.Cleanup(s.Close)
+		return s.Listener.Addr().String()
+	}
+	env.http4 = start("tcp4", "127.0.0.1:0", false)
+	env.https4 = start("tcp4", "127.0.0.1:0", true)
+	env.http6 = start("tcp6", "[::1]:0", false)
+	env.https6 = start("tcp6", "[::1]:0", true)
+	g := listen(t, "tcp6", "[::1]:0")
+	t.Cleanup(func() { g.Close() })
+	go func() {
+		for {
+			conn, e := g.Accept()
+			if e != nil {
+				return
+			}
+			conn.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+			conn.Close()
+		}
+	}()
+	env.garbage6 = g.Addr().String()
+	l := listen(t, "tcp4", "127.0.0.1:0")
+	env.closed = l.Addr().String()
+	l.Close()
+	return env
+}
+
+func (env probeEnv) prober(resolver Resolver, addrs map[string]string, now time.Time) *Prober {
+	return &Prober{
+		Resolver:  resolver,
+		Dialer:    fakeDialer{addrs: addrs, closed: env.closed},
+		Now:       func() time.Time { return now },
+		TLSConfig: &tls.Config{RootCAs: env.pool},
+		Timeout:   time.Second * 5,
+		DialQUIC: func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+			return nil, errors.New("quic disabled in tests")
+		},
+	}
+}
+
+func TestProberCheck(t *testing.T) {
+	var env = newProbeEnv(t)
+	var now = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	var v4 = map[string]string{"127.0.0.1:80": env.http4, "127.0.0.1:443": env.https4}
+	var v6 = map[string]string{"[::1]:80": env.http6, "[::1]:443": env.https6}
+	var dual = map[string]string{}
+	for k, v := range v4 {
+		dual[k] = v
+	}
+	for k, v := range v6 {
+		dual[k] = v
+	}
+	var cases = []struct {
+		name                   string
+		addrs                  []string
+		dial                   map[string]string
+		v4hp, v4hs, v6hp, v6hs ProbeStatus
+		v6time                 bool
+	}{
+		{"v4 only", []string{"127.0.0.1"}, v4, StatusOK, StatusOK, StatusNoRecord, StatusNoRecord, false},
+		{"v6 only", []string{"::1"}, v6, StatusNoRecord, StatusNoRecord, StatusOK, StatusOK, true},
+		{"dual stack", []string{"127.0.0.1", "::1"}, dual, StatusOK, StatusOK, StatusOK, StatusOK, true},
+		{"tls failure", []string{"127.0.0.1", "::1"}, map[string]string{
+			"127.0.0.1:80": env.http4, "127.0.0.1:443": env.https4,
+			"[::1]:80": env.http6, "[::1]:443": env.garbage6,
+		}, StatusOK, StatusOK, StatusOK, StatusTLSHandshake, true},
+		{"refused", []string{"127.0.0.1", "::1"}, v4, StatusOK, StatusOK, StatusRefused, StatusRefused, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var pr = env.prober(fakeResolver{"example.com": c.addrs}, c.dial, now)
+			var r = pr.Check(context.Background(), Site{ID: 1, Domain: "example.com"})
+			var s = r.Site
+			if s.V4hp != c.v4hp || s.V4hs != c.v4hs || s.V6hp != c.v6hp || s.V6hs != c.v6hs {
+				t.Errorf("v4hp %v v4hs %v v6hp %v v6hs %v, want %v %v %v %v", s.V4hp, s.V4hs, s.V6hp, s.V6hs, c.v4hp, c.v4hs, c.v6hp, c.v6hs)
+			}
+			if c.v6time != s.V6time.Equal(now) {
+				t.Errorf("v6time %v", s.V6time)
+			}
+			if len(s.Addrs) != len(c.addrs) {
+				t.Errorf("%d addrs, want %d", len(s.Addrs), len(c.addrs))
+			}
+			for _, p := range r.Probes {
+				if p.SID != 1 || p.Status == 0 {
+					t.Errorf("probe %+v", p)
+				}
+			}
+		})
+	}
+}
+
+func TestProberCheckHTTP2(t *testing.T) {
+	var env = newProbeEnv(t)
+	var pr = env.prober(fakeResolver{"example.com": {"::1"}}, map[string]string{"[::1]:80": env.http6, "[::1]:443": env.https6}, time.Now())
+	var s = pr.Check(context.Background(), Site{ID: 1, Domain: "example.com"}).Site
+	if s.V6h2 != StatusOK || len(s.Certs) != 1 || !s.Certs[0].ChainValid {
+		t.Errorf("v6h2 %v certs %+v", s.V6h2, s.Certs)
+	}
+}
+
+func TestProberCheckNoRecord(t *testing.T) {
+	var env = newProbeEnv(t)
+	var pr = env.prober(fakeResolver{}, nil, time.Now())
+	//上一次检测的结果不能留下
+	var prev = Site{ID: 1, Domain: "example.com", IPv6: "::1", V6hp: StatusOK, V6h3: StatusOK, V6Penalty: 3, Addrs: []Addr{{IP: "::1", Family: 6}}}
+	var r = pr.Check(context.Background(), prev)
+	var s = r.Site
+	if s.V4hp != StatusNoRecord || s.V6hp != StatusNoRecord || s.V6h3 != StatusNoRecord {
+		t.Errorf("v4hp %v v6hp %v v6h3 %v", s.V4hp, s.V6hp, s.V6h3)
+	}
+	if s.IPv6 != "" || s.Addrs != nil || s.V6Penalty != 0 {
+		t.Errorf("stale result %+v", s)
+	}
+	if len(r.Probes) != 1 || r.Probes[0].Scheme != "dns" {
+		t.Errorf("probes %+v", r.Probes)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xormplus/xorm"
+)
+
+// siteQuery 站点列表的筛选、排序和分页，页面和 /api/v1 共用
+type siteQuery struct {
+	Domain     string  //域名包含
+	Family     int     //4 或 6
+	Support    string  //http https h2 h3，与 Family 一起表示该协议族支持，只有 Family 时表示有该协议族的地址
+	Label      string  //lable 表的 lable
+	Classify   string  //lable 表的 classify
+	Expire     int     //证书在多少天内过期，包括已经过期的
+	SupportV6  bool    //曾经支持过 v6，即 v6time 不为空
+	MinPenalty float64 //v6 首字节时间至少是 v4 的几倍
+	Sort       string  //sortFields 中的字段，前面加 - 表示倒序
+	Cursor     string  //上一页返回的游标
+	Offset     int     //页面上的查看更多仍然按页读取
+	Limit      int     //0 表示不限制
+}
+
+// sortFields 允许排序的字段
+var sortFields = map[string]bool{
+	"id":        true,
+	"domain":    true,
+	"created":   true,
+	"updated":   true,
+	"v6time":    true,
+	"cetime":    true,
+	"v6penalty": true,
+}
+
+// nullSortFields 可能为空的排序字段，空值统一排在最后
+var nullSortFields = map[string]bool{
+	"v6time": true,
+	"cetime": true,
+}
+
+// supportCols Support 对应的字段，%d 为协议族
+var supportCols = map[string]string{
+	"http":  "v%dhp",
+	"https": "v%dhs",
+	"h2":    "v%dh2",
+	"h3":    "v%dh3",
+}
+
+const cursorTime = "2006-01-02 15:04:05"
+
+// cursor 上一页最后一条记录的排序字段和 id，排序字段为空时 V 为 nil
+type cursor struct {
+	V  interface{} `json:"v"`
+	ID int         `json:"id"`
+}
+
+// parseSiteQuery 读取 /api/v1/sites 的参数
+func parseSiteQuery(v url.Values) (siteQuery, error) {
+	var q = siteQuery{
+		Domain:   v.Get("domain"),
+		Support:  v.Get("support"),
+		Label:    v.Get("label"),
+		Classify: v.Get("classify"),
+		Sort:     v.Get("sort"),
+		Cursor:   v.Get("cursor"),
+		Limit:    20,
+	}
+	var e error
+	if s := v.Get("family"); s != "" {
+		if q.Family, e = strconv.Atoi(s); e != nil || (q.Family != 4 && q.Family != 6) {
+			return q, errors.New("family must be 4 or 6")
+		}
+	}
+	if q.Support != "" && (supportCols[q.Support] == "" || q.Family == 0) {
+		return q, errors.New("support must be http, https, h2 or h3 and requires family")
+	}
+	if s := v.Get("expire"); s != "" {
+		if q.Expire, e = strconv.Atoi(s); e != nil || q.Expire <= 0 {
+			return q, errors.New("expire must be a positive number of days")
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, e = strconv.Atoi(s); e != nil || q.Limit < 1 || q.Limit > 100 {
+			return q, errors.New("limit must be between 1 and 100")
+		}
+	}
+	if q.Sort == "" {
+		q.Sort = "-id"
+	}
+	if !sortFields[strings.TrimPrefix(q.Sort, "-")] {
+		return q, fmt.Errorf("unknown sort field %s", q.Sort)
+	}
+	if q.Cursor != "" {
+		if _, e := q.cursor(); e != nil {
+			return q, errors.New("invalid cursor")
+		}
+	}
+	return q, nil
+}
+
+func (q siteQuery) field() (string, bool) {
+	var sort = q.Sort
+	if sort == "" {
+		sort = "-id"
+	}
+	return strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+}
+
+func (q siteQuery) cursor() (cursor, error) {
+	var c cursor
+	b, e := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if e != nil {
+		return c, e
+	}
+	return c, json.Unmarshal(b, &c)
+}
+
+// where 不含排序和分页的条件
+func (q siteQuery) where() *xorm.Session {
+	var s = db.Table("site").Where("1 = 1")
+	if q.Domain != "" {
+		s = s.And("site.domain like ?", "%"+q.Domain+"%")
+	}
+	if q.Family != 0 && q.Support != "" {
+		s = s.And(fmt.Sprintf("site."+supportCols[q.Support]+" in (?, ?)", q.Family), StatusOK, StatusPartial)
+	} else if q.Family != 0 {
+		s = s.And(fmt.Sprintf("site.ipv%d != ''", q.Family))
+	}
+	if q.Expire > 0 {
+		s = s.And("site.cetime is not null and site.cetime < ?", time.Now().UTC().Add(time.Hour*24*time.Duration(q.Expire)))
+	}
+	if q.SupportV6 {
+		s = s.And("site.v6time is not null")
+	}
+	if q.MinPenalty > 0 {
+		s = s.And("site.v6penalty > ?", q.MinPenalty)
+	}
+	if q.Label != "" || q.Classify != "" {
+		s = s.Join("INNER", "lable", "lable.sid = site.id")
+		if q.Label != "" {
+			s = s.And("lable.lable = ?", q.Label)
+		}
+		if q.Classify != "" {
+			s = s.And("lable.classify = ?", q.Classify)
+		}
+	}
+	return s
+}
+
+// Count 符合条件的站点数，一个站点有多个标签时只算一次
+func (q siteQuery) Count() (int64, error) {
+	return q.where().Select("count(distinct site.id)").Count(&Site{})
+}
+
+// Find 返回一页站点和下一页的游标，没有下一页时游标为空
+func (q siteQuery) Find() ([]Site, string, error) {
+	var s = q.where()
+	if q.Label != "" || q.Classify != "" {
+		s = s.Select("site.*").GroupBy("site.id")
+	}
+	field, desc := q.field()
+	if q.Cursor != "" {
+		c, e := q.cursor()
+		if e != nil {
+			return nil, "", e
+		}
+		var op = ">"
+		if desc {
+			op = "<"
+		}
+		switch {
+		case c.V == nil:
+			//上一页停在排在最后的空值中
+			s = s.And(fmt.Sprintf("site.%s is null and site.id %s ?", field, op), c.ID)
+		case nullSortFields[field]:
+			s = s.And(fmt.Sprintf("(site.%s %s ? or (site.%s = ? and site.id %s ?) or site.%s is null)", field, op, field, op, field), c.V, c.V, c.ID)
+		default:
+			s = s.And(fmt.Sprintf("(site.%s %s ? or (site.%s = ? and site.id %s ?))", field, op, field, op), c.V, c.V, c.ID)
+		}
+	}
+	if nullSortFields[field] {
+		//各数据库中空值的位置不同，明确排在最后，与游标的条件一致
+		s = s.OrderBy(fmt.Sprintf("site.%s is null", field))
+	}
+	if desc {
+		s = s.Desc("site." + field).Desc("site.id")
+	} else {
+		s = s.Asc("site." + field).Asc("site.id")
+	}
+	if q.Limit > 0 {
+		//多取一条判断是否还有下一页
+		s = s.Limit(q.Limit+1, q.Offset)
+	} else if q.Offset > 0 {
+		s = s.Limit(1<<31-1, q.Offset)
+	}
+	var sites []Site
+	if e := s.Find(&sites); e != nil {
+		return nil, "", e
+	}
+	if q.Limit == 0 || len(sites) <= q.Limit {
+		return sites, "", nil
+	}
+	sites = sites[:q.Limit]
+	var last = sites[len(sites)-1]
+	b, _ := json.Marshal(cursor{V: last.sortValue(field), ID: last.ID})
+	return sites, base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sortValue 排序字段的值，时间按数据库中保存的格式，空的时间返回 nil
+func (site Site) sortValue(field string) interface{} {
+	switch field {
+	case "domain":
+		return site.Domain
+	case "created":
+		return site.Created.Local().Format(cursorTime)
+	case "updated":
+		return site.Updated.Local().Format(cursorTime)
+	case "v6time":
+		if site.V6time.IsZero() {
+			return nil
+		}
+		return site.V6time.Local().Format(cursorTime)
+	case "cetime":
+		if site.CETime.IsZero() {
+			return nil
+		}
+		return site.CETime.Local().Format(cursorTime)
+	case "v6penalty":
+		return site.V6Penalty
+	}
+	return site.ID
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter 按地址段和注册域名限制探测频率，避免同一运营商下的大量站点被同时检测
+// 为 nil 或者频率为 0 时不限制
+type RateLimiter struct {
+	PerNet    rate.Limit //每个 v4 /24 或 v6 /48 每秒的连接数
+	PerDomain rate.Limit //每个注册域名每秒开始检测的站点数
+	PerLogin  rate.Limit //每个来源地址每秒允许登录失败的次数，v6 按 /64 计算
+	Burst     int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	pruned   time.Time //上次清理 limiters 的时间
+}
+
+// pruneEvery 清理空闲 rate.Limiter 的间隔
+const pruneEvery = time.Minute
+
+func newRateLimiter(perNet, perDomain float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{PerNet: rate.Limit(perNet), PerDomain: rate.Limit(perDomain), Burst: burst, limiters: map[string]*rate.Limiter{}}
+}
+
+// use 在锁内取出 key 的 rate.Limiter 交给 f，顺便清理空闲的 rate.Limiter
+func (l *RateLimiter) use(key string, r rate.Limit, f func(lim *rate.Limiter)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.pruned) >= pruneEvery {
+		l.prune()
+		l.pruned = now
+	}
+	lim, ok := l.limiters[key]
+	if !ok {
+		lim = rate.NewLimiter(r, l.Burst)
+		l.limiters[key] = lim
+	}
+	f(lim)
+}
+
+// prune 删除令牌已经攒满的 rate.Limiter，它们和新建的没有区别，地址段和来源地址再多也不会一直占用内存
+// 调用时持有 l.mu，取令牌也都在锁内，不会有人拿着被删除的 rate.Limiter
+func (l *RateLimiter) prune() {
+	for key, lim := range l.limiters {
+		if lim.Tokens() >= float64(l.Burst) {
+			delete(l.limiters, key)
+		}
+	}
+}
+
+// wait 等到取得令牌或者 ctx 结束
+// 不用 rate.Limiter.Wait：排队时间超过 ctx 的期限时它立即返回错误，检测还没超时就被记成失败
+// 这里出错时一定是 ctx 已经结束，调度器会把整个任务算作失败，不会保存成站点不支持
+func (l *RateLimiter) wait(ctx context.Context, key string, r rate.Limit) error {
+	if l == nil || r <= 0 {
+		return nil
+	}
+	var res *rate.Reservation
+	l.use(key, r, func(lim *rate.Limiter) { res = lim.Reserve() })
+	var delay = res.Delay()
+	if delay == 0 {
+		return nil
+	}
+	var t = time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		res.Cancel()
+		return ctx.Err()
+	}
+}
+
+// WaitIP 连接 ip 之前调用
+func (l *RateLimiter) WaitIP(ctx context.Context, ip string) error {
+	return l.wait(ctx, "net:"+netKey(ip), l.perNet())
+}
+
+// WaitDomain 开始检测站点之前调用
+func (l *RateLimiter) WaitDomain(ctx context.Context, domain string) error {
+	return l.wait(ctx, "domain:"+suffixKey(domain), l.perDomain())
+}
+
+// LoginBlocked 来源地址登录失败太多，需要等一段时间再登录
+func (l *RateLimiter) LoginBlocked(ip string) bool {
+	if l == nil || l.PerLogin <= 0 {
+		return false
+	}
+	var blocked bool
+	l.use("login:"+clientKey(ip), l.PerLogin, func(lim *rate.Limiter) { blocked = lim.Tokens() < 1 })
+	return blocked
+}
+
+// LoginFailed 记录来源地址一次登录失败
+func (l *RateLimiter) LoginFailed(ip string) {
+	if l == nil || l.PerLogin <= 0 {
+		return
+	}
+	l.use("login:"+clientKey(ip), l.PerLogin, func(lim *rate.Limiter) { lim.Allow() })
+}
+
+func (l *RateLimiter) perNet() rate.Limit {
+	if l == nil {
+		return 0
+	}
+	return l.PerNet
+}
+
+func (l *RateLimiter) perDomain() rate.Limit {
+	if l == nil {
+		return 0
+	}
+	return l.PerDomain
+}
+
+// netKey v4 取 /24，v6 取 /48
+func netKey(ip string) string {
+	var addr = net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// clientKey 登录限速的来源，v4 取单个地址，v6 取 /64，一个用户通常能用整个 /64
+func clientKey(ip string) string {
+	var addr = net.ParseIP(ip)
+	if addr == nil || addr.To4() != nil {
+		return ip
+	}
+	return addr.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// suffixKey 注册域名，比如 www.tsinghua.edu.cn 和 mail.tsinghua.edu.cn 都是 tsinghua.edu.cn
+func suffixKey(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if d, e := publicsuffix.EffectiveTLDPlusOne(domain); e == nil {
+		return d
+	}
+	return domain
+}
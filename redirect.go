@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// maxHops 跳转链最多跟随的次数，与 net/http 默认值一致
+const maxHops = 10
+
+// Hop struct
+// 跳转链中的一跳
+type Hop struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"` //HTTP 状态码，请求失败时为0
+	IP     string `json:"ip"`
+	Family int    `json:"family"`
+	Error  string `json:"error,omitempty"`
+}
+
+// followRedirects 只通过某一协议族从 http://domain/ 开始跟随跳转，记录每一跳
+// 第一跳之后任何一跳没有该协议族的地址或者无法访问，都视为跳转链断开
+func (pr *Prober) followRedirects(ctx context.Context, domain string, v int) ([]Hop, ProbeStatus) {
+	var hops []Hop
+	var lost = func(s ProbeStatus) ProbeStatus {
+		if len(hops) > 1 {
+			return StatusRedirectLost
+		}
+		return s
+	}
+	var next = fmt.Sprintf("http://%s/", domain)
+	for len(hops) < maxHops {
+		var hop = Hop{URL: next, Family: v}
+		u, e := url.Parse(next)
+		if e != nil {
+			hop.Error = e.Error()
+			hops = append(hops, hop)
+			return hops, lost(StatusUnknown)
+		}
+		ips, e := pr.Resolver.LookupHost(ctx, u.Hostname())
+		for _, ip := range ips {
+			if (net.ParseIP(ip).To4() != nil) == (v == 4) {
+				hop.IP = ip
+				break
+			}
+		}
+		if hop.IP == "" {
+			if e == nil {
+				e = &net.DNSError{Err: "no such host", Name: u.Hostname(), IsNotFound: true}
+			}
+			hop.Error = e.Error()
+			hops = append(hops, hop)
+			return hops, lost(classify(e))
+		}
+		resp, e := pr.request(ctx, "HEAD", next, hop.IP)
+		if e != nil {
+			hop.Error = e.Error()
+			hops = append(hops, hop)
+			return hops, lost(classify(e))
+		}
+		hop.Status = resp.StatusCode
+		hops = append(hops, hop)
+		loc, e := resp.Location()
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 || e != nil {
+			if resp.StatusCode >= 500 {
+				return hops, lost(StatusHTTPError)
+			}
+			return hops, StatusOK
+		}
+		next = loc.String()
+	}
+	return hops, StatusUnknown
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Schedule 决定每个站点下次检测的时间
+type Schedule struct {
+	Interval time.Duration //正常情况下的检测间隔
+	Min      time.Duration //状态刚变化或证书快过期时的检测间隔
+	Max      time.Duration //无法访问的站点退避的上限
+	Jitter   float64       //在间隔上随机增减的比例，把检测分散到一天中
+	Rand     func() float64
+}
+
+// certSoon 证书在这个时间内过期时缩短检测间隔
+const certSoon = time.Hour * 24 * 7
+
+var schedule = &Schedule{
+	Interval: time.Hour * 24,
+	Min:      time.Hour,
+	Max:      time.Hour * 24 * 7,
+	Jitter:   0.2,
+	Rand:     rand.Float64,
+}
+
+// Next 根据检测前后的站点返回下次检测时间和连续失败次数
+func (s *Schedule) Next(prev, cur Site, now time.Time) (time.Time, int) {
+	var fails = 0
+	var interval = s.Interval
+	switch {
+	case dead(cur):
+		//连续失败时间隔翻倍，直到 Max
+		fails = prev.Fails + 1
+		interval = s.Interval
+		for i := 1; i < fails && interval < s.Max; i++ {
+			interval *= 2
+		}
+		if interval > s.Max {
+			interval = s.Max
+		}
+	case changed(prev, cur):
+		interval = s.Min
+	case cur.CETime.After(now) && cur.CETime.Before(now.Add(certSoon)):
+		//已经过期的证书不再缩短间隔，没人维护的站点按正常间隔或退避检测
+		interval = s.Min
+	}
+	if s.Jitter > 0 && s.Rand != nil {
+		interval += time.Duration(float64(interval) * s.Jitter * (2*s.Rand() - 1))
+	}
+	return now.Add(interval), fails
+}
+
+// Failed 检测出错（超时、panic 等）时按站点无法访问退避，返回下次检测时间和连续失败次数
+func (s *Schedule) Failed(prev Site, now time.Time) (time.Time, int) {
+	return s.Next(prev, Site{}, now)
+}
+
+// postpone 保存检测出错的站点的下次检测时间
+func postpone(site Site) {
+	next, fails := schedule.Failed(site, time.Now())
+	if _, e := db.ID(site.ID).Cols("next_check", "fails").Update(&Site{NextCheck: next, Fails: fails}); e != nil {
+		log.Printf("postpone site %d: %s", site.ID, e)
+	}
+}
+
+// dead 两个协议族的 http 和 https 都无法访问
+func dead(site Site) bool {
+	return !site.V4hp.Supported() && !site.V4hs.Supported() && !site.V6hp.Supported() && !site.V6hs.Supported()
+}
+
+// changed 与上次相比地址或支持情况有变化，第一次检测不算变化
+func changed(prev, cur Site) bool {
+	if prev.V4hp == 0 {
+		return false
+	}
+	return prev.IPv4 != cur.IPv4 || prev.IPv6 != cur.IPv6 ||
+		prev.V4hp != cur.V4hp || prev.V6hp != cur.V6hp ||
+		prev.V4hs != cur.V4hs || prev.V6hs != cur.V6hs ||
+		prev.V4h2 != cur.V4h2 || prev.V6h2 != cur.V6h2
+}
+
+// dueLoop 定时把到了检测时间的站点交给调度器
+func dueLoop(every time.Duration) {
+	var t = time.NewTicker(every)
+	for {
+		submitDue()
+		resumeJobs()
+		<-t.C
+	}
+}
+
+func submitDue() {
+	var sites []Site
+	if err := db.Where("next_check is null or next_check <= ?", time.Now()).Asc("next_check").Limit(1000).Find(&sites); err != nil {
+		log.Printf("find due sites: %s", err)
+		return
+	}
+	var n int
+	for _, site := range sites {
+		if enqueue(site) {
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("%d sites due", n)
+	}
+}
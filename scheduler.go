@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Scheduler 固定数量的 worker 从队列中取出任务检测，结果交给一个 goroutine 依次保存
+type Scheduler struct {
+	Workers int
+	Timeout time.Duration                                   //每个站点检测的时间上限
+	Check   func(ctx context.Context, job *Job) checkResult //可以修改 job，Save 收到的是修改后的
+	Save    func(job Job, r checkResult)
+	Limit   *RateLimiter //开始检测前按域名限速
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []Job
+	active  map[int]bool //在队列中或正在检测的站点，避免重复检测
+	stopped bool
+	pending sync.WaitGroup //已提交还没保存的任务
+	workers sync.WaitGroup
+	results chan jobResult
+	saved   chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+type jobResult struct {
+	job Job
+	r   checkResult
+}
+
+func newScheduler(workers int, timeout time.Duration, check func(ctx context.Context, job *Job) checkResult, save func(job Job, r checkResult)) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	var s = &Scheduler{Workers: workers, Timeout: timeout, Check: check, Save: save, active: map[int]bool{}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Start 启动 worker 和保存结果的 goroutine
+func (s *Scheduler) Start() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.results = make(chan jobResult, s.Workers)
+	s.saved = make(chan struct{})
+	go func() {
+		for jr := range s.results {
+			s.Save(jr.job, jr.r)
+			s.mu.Lock()
+			delete(s.active, jr.job.SID)
+			s.mu.Unlock()
+			s.pending.Done()
+		}
+		close(s.saved)
+	}()
+	for i := 0; i < s.Workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+}
+
+// Active 站点是否在队列中或正在检测
+func (s *Scheduler) Active(sid int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active[sid]
+}
+
+// Submit 把任务加入队列，调度器已经停止或者站点已经在队列中时返回 false
+func (s *Scheduler) Submit(job Job) bool {
+	return s.Reserve(job.SID) && s.SubmitReserved(job)
+}
+
+// Reserve 占用站点，占用期间其它 Reserve 和 Submit 都返回 false
+// 用于在创建任务记录之前占住站点，成功后必须调用 SubmitReserved 或 Release
+func (s *Scheduler) Reserve(sid int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.active[sid] {
+		return false
+	}
+	s.active[sid] = true
+	return true
+}
+
+// Release 放弃 Reserve 占用的站点
+func (s *Scheduler) Release(sid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, sid)
+}
+
+// SubmitReserved 把已经 Reserve 的站点的任务加入队列，调度器已经停止时放弃占用并返回 false
+func (s *Scheduler) SubmitReserved(job Job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		delete(s.active, job.SID)
+		return false
+	}
+	s.pending.Add(1)
+	s.queue = append(s.queue, job)
+	s.cond.Signal()
+	return true
+}
+
+// Len 队列中还没开始检测的任务数
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Wait 等待所有已提交的任务检测完并保存
+func (s *Scheduler) Wait() {
+	s.pending.Wait()
+}
+
+// Stop 不再接受新的任务，丢弃还没开始的，等正在检测的任务完成后返回
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for _, job := range s.queue {
+		delete(s.active, job.SID)
+		s.pending.Done()
+	}
+	s.queue = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.workers.Wait()
+	close(s.results)
+	<-s.saved
+	s.cancel()
+}
+
+// next 取出下一个任务，队列为空时等待，调度器停止后返回 false
+func (s *Scheduler) next() (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) == 0 && !s.stopped {
+		s.cond.Wait()
+	}
+	if s.stopped {
+		return Job{}, false
+	}
+	var job = s.queue[0]
+	s.queue = s.queue[1:]
+	return job, true
+}
+
+func (s *Scheduler) work() {
+	defer s.workers.Done()
+	for {
+		job, ok := s.next()
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, s.Timeout)
+		var r checkResult
+		if e := s.Limit.WaitDomain(ctx, job.Site.Domain); e != nil {
+			r = checkResult{Site: job.Site, Err: e}
+		} else {
+			r = s.run(ctx, &job)
+		}
+		if r.Err == nil && ctx.Err() != nil {
+			r.Err = ctx.Err()
+		}
+		cancel()
+		s.results <- jobResult{job: job, r: r}
+	}
+}
+
+// run 检测中的 panic 只让这个任务失败
+func (s *Scheduler) run(ctx context.Context, job *Job) (r checkResult) {
+	defer func() {
+		if v := recover(); v != nil {
+			r = checkResult{Site: job.Site, Err: fmt.Errorf("panic: %v", v)}
+		}
+	}()
+	return s.Check(ctx, job)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// securityHeaders 需要记录的安全相关响应头
+var securityHeaders = []string{
+	"Content-Security-Policy",
+	"X-Frame-Options",
+	"X-Content-Type-Options",
+	"Referrer-Policy",
+	"Permissions-Policy",
+}
+
+// alpnProtos 逐个尝试的 ALPN 协议
+var alpnProtos = []string{"h2", "http/1.1"}
+
+// Security struct
+// 某个地址 https 响应中的 HSTS、安全头以及 ALPN
+type Security struct {
+	IP                string            `json:"ip"`
+	Family            int               `json:"family"`
+	HSTS              bool              `json:"hsts"`
+	MaxAge            int64             `json:"max_age"` //秒
+	IncludeSubDomains bool              `json:"include_subdomains"`
+	Preload           bool              `json:"preload"`
+	Headers           map[string]string `json:"headers"`    //存在的安全头
+	Negotiated        string            `json:"negotiated"` //检测请求协商出的协议
+	ALPN              []string          `json:"alpn"`       //服务器接受的 ALPN 协议
+}
+
+// security 分析 https 响应头，并逐个协议握手得到服务器接受的 ALPN
+func (pr *Prober) security(ctx context.Context, domain string, ip string, family int, resp *http.Response) Security {
+	var sec = Security{IP: ip, Family: family, Headers: map[string]string{}}
+	sec.HSTS, sec.MaxAge, sec.IncludeSubDomains, sec.Preload = parseHSTS(resp.Header.Get("Strict-Transport-Security"))
+	for _, h := range securityHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			sec.Headers[h] = v
+		}
+	}
+	if resp.TLS != nil {
+		sec.Negotiated = resp.TLS.NegotiatedProtocol
+	}
+	var network = "tcp6"
+	if family == 4 {
+		network = "tcp4"
+	}
+	//与产生 resp 的请求使用同一个端口
+	var port = "443"
+	if resp.Request != nil && resp.Request.URL.Port() != "" {
+		port = resp.Request.URL.Port()
+	}
+	for _, proto := range alpnProtos {
+		if pr.acceptsALPN(ctx, network, domain, net.JoinHostPort(ip, port), proto) {
+			sec.ALPN = append(sec.ALPN, proto)
+		}
+	}
+	return sec
+}
+
+// acceptsALPN 只提供一个协议握手，服务器选择了它说明支持，addr 为 ip:port
+func (pr *Prober) acceptsALPN(ctx context.Context, network string, domain string, addr string, proto string) bool {
+	ip, _, e := net.SplitHostPort(addr)
+	if e != nil {
+		return false
+	}
+	if e := pr.Limit.WaitIP(ctx, ip); e != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, pr.Timeout)
+	defer cancel()
+	conn, e := pr.Dialer.DialContext(ctx, network, addr)
+	if e != nil {
+		return false
+	}
+	defer conn.Close()
+	var conf = pr.inspectConfig()
+	conf.ServerName, conf.NextProtos = domain, []string{proto}
+	var client = tls.Client(conn, conf)
+	if e := client.HandshakeContext(ctx); e != nil {
+		return false
+	}
+	return client.ConnectionState().NegotiatedProtocol == proto
+}
+
+// parseHSTS 解析 Strict-Transport-Security，max-age 为 0 表示取消 HSTS
+func parseHSTS(v string) (hsts bool, maxAge int64, sub bool, preload bool) {
+	for _, d := range strings.Split(v, ";") {
+		d = strings.TrimSpace(d)
+		switch {
+		case strings.HasPrefix(strings.ToLower(d), "max-age="):
+			maxAge, _ = strconv.ParseInt(strings.Trim(d[len("max-age="):], `"`), 10, 64)
+		case strings.EqualFold(d, "includeSubDomains"):
+			sub = true
+		case strings.EqualFold(d, "preload"):
+			preload = true
+		}
+	}
+	return maxAge > 0, maxAge, sub, preload
+}
+
+// hstsStatus 汇总同一协议族所有地址的 HSTS，没有 https 的协议族为 StatusNoRecord
+func hstsStatus(list []Security, v int) ProbeStatus {
+	var status []ProbeStatus
+	for _, s := range list {
+		if s.Family != v {
+			continue
+		}
+		if s.HSTS {
+			status = append(status, StatusOK)
+		} else {
+			status = append(status, StatusUnknown)
+		}
+	}
+	return combine(status)
+}
+
+// checkHSTS 在 https 旁边显示 HSTS，鼠标悬停显示安全头和 ALPN
+func checkHSTS(site Site, v int) string {
+	var p = site.V4hsts
+	if v == 6 {
+		p = site.V6hsts
+	}
+	var lines []string
+	for _, s := range site.Security {
+		if s.Family != v {
+			continue
+		}
+		var line = fmt.Sprintf("%s: 无 HSTS", s.IP)
+		if s.HSTS {
+			line = fmt.Sprintf("%s: max-age=%d", s.IP, s.MaxAge)
+			if s.IncludeSubDomains {
+				line += " includeSubDomains"
+			}
+			if s.Preload {
+				line += " preload"
+			}
+		}
+		lines = append(lines, line)
+		for _, h := range securityHeaders {
+			if _, ok := s.Headers[h]; ok {
+				lines = append(lines, h)
+			}
+		}
+		lines = append(lines, "ALPN "+strings.Join(s.ALPN, ","))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	var class, text = "btn-outline-secondary", "无 HSTS"
+	switch p {
+	case StatusOK:
+		class, text = "btn-outline-success", "HSTS"
+	case StatusPartial:
+		class, text = "btn-outline-warning", "部分 HSTS"
+	}
+	return fmt.Sprintf(` <button type="button" class="btn %s btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">%s</button>`, class, tooltip(lines...), text)
+}
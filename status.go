@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ProbeStatus 检测状态
+// 1 2 3 与旧数据保持一致：1 不支持 2 支持 3 部分地址支持，之后的取值为具体的失败原因
+type ProbeStatus int
+
+const (
+	StatusUnknown      ProbeStatus = iota + 1 //未检测或不支持
+	StatusOK                                  //支持
+	StatusPartial                             //部分地址支持
+	StatusNoRecord                            //没有 A/AAAA 记录
+	StatusDNSError                            //域名解析失败
+	StatusRefused                             //连接被拒绝
+	StatusTimeout                             //连接或请求超时
+	StatusTLSHandshake                        //TLS 握手失败
+	StatusCertInvalid                         //证书无效
+	StatusHTTPError                           //HTTP 返回了 5xx 状态码，检测目标为与 Expect 不符
+	StatusRedirectLost                        //跳转链中途失去 IPv6
+)
+
+// errRefused 对方有应答但拒绝提供服务，归为 StatusRefused
+var errRefused = errors.New("refused")
+
+var statusText = map[ProbeStatus]string{
+	StatusUnknown:      "不支持",
+	StatusOK:           "已支持",
+	StatusPartial:      "部分支持",
+	StatusNoRecord:     "没有dns记录",
+	StatusDNSError:     "dns解析失败",
+	StatusRefused:      "连接被拒绝",
+	StatusTimeout:      "连接超时",
+	StatusTLSHandshake: "TLS握手失败",
+	StatusCertInvalid:  "证书无效",
+	StatusHTTPError:    "HTTP状态码错误",
+	StatusRedirectLost: "跳转后不支持IPv6",
+}
+
+func (s ProbeStatus) String() string {
+	if t, ok := statusText[s]; ok {
+		return t
+	}
+	return statusText[StatusUnknown]
+}
+
+// Supported 至少有一个地址可以访问
+func (s ProbeStatus) Supported() bool {
+	return s == StatusOK || s == StatusPartial
+}
+
+// classify 把请求返回的错误归类到具体的失败原因
+func classify(e error) ProbeStatus {
+	if e == nil {
+		return StatusOK
+	}
+	var dnsErr *net.DNSError
+	if errors.As(e, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return StatusNoRecord
+		}
+		return StatusDNSError
+	}
+	var certErr *tls.CertificateVerificationError
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(e, &certErr) || errors.As(e, &hostErr) || errors.As(e, &authErr) || errors.As(e, &invalidErr) {
+		return StatusCertInvalid
+	}
+	if errors.Is(e, syscall.ECONNREFUSED) || errors.Is(e, errRefused) {
+		return StatusRefused
+	}
+	var netErr net.Error
+	if errors.As(e, &netErr) && netErr.Timeout() {
+		return StatusTimeout
+	}
+	var recordErr tls.RecordHeaderError
+	if errors.As(e, &recordErr) || strings.Contains(e.Error(), "tls:") {
+		return StatusTLSHandshake
+	}
+	return StatusUnknown
+}
+
+// combine 汇总多个结果：全部支持为 StatusOK，部分支持为 StatusPartial，
+// 都不支持时取第一个失败原因，没有结果时为 StatusNoRecord
+func combine(list []ProbeStatus) ProbeStatus {
+	var ok int
+	var fail ProbeStatus
+	for _, s := range list {
+		if s == StatusOK {
+			ok++
+		} else if fail == 0 {
+			fail = s
+		}
+	}
+	switch {
+	case len(list) == 0:
+		return StatusNoRecord
+	case ok == 0:
+		return fail
+	case ok < len(list):
+		return StatusPartial
+	}
+	return StatusOK
+}
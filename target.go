@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Target struct
+// 站点额外的检测目标，比如 mail.x.edu.cn:8443/owa
+type Target struct {
+	ID      int64       `json:"id" xorm:"pk autoincr 'id'"`
+	SID     int         `json:"sid" xorm:"sid index"`
+	Scheme  string      `json:"scheme" xorm:"scheme"` //http 或 https
+	Port    int         `json:"port" xorm:"port"`     //0 表示协议的默认端口
+	Path    string      `json:"path" xorm:"path"`
+	Expect  int         `json:"expect" xorm:"expect"` //期望的状态码，0 表示小于 500 都算正常
+	V4      ProbeStatus `json:"v4" xorm:"v4"`         //最近一次 v4 的检测结果
+	V6      ProbeStatus `json:"v6" xorm:"v6"`         //最近一次 v6 的检测结果
+	Checked time.Time   `json:"checked" xorm:"checked"`
+	V4Text  string      `json:"v4text" xorm:"-"` //V4 的文字说明，只用于页面显示
+	V6Text  string      `json:"v6text" xorm:"-"`
+	Link    string      `json:"url" xorm:"-"` //带站点域名的完整地址，只用于页面显示
+	Created time.Time   `json:"created" xorm:"created"`
+	Updated time.Time   `json:"updated" xorm:"updated"`
+}
+
+// URL 用站点的域名拼出完整地址
+func (t Target) URL(domain string) string {
+	var host = domain
+	if t.Port != 0 {
+		host = net.JoinHostPort(domain, strconv.Itoa(t.Port))
+	}
+	return fmt.Sprintf("%s://%s%s", t.Scheme, host, t.Path)
+}
+
+func (t Target) expected(code int) bool {
+	if t.Expect == 0 {
+		return code < http.StatusInternalServerError
+	}
+	return code == t.Expect
+}
+
+// checkTargets 用站点的每个地址检测每个目标，结果写回 site.Targets
+func (pr *Prober) checkTargets(ctx context.Context, site *Site) []ProbeResult {
+	var probes []ProbeResult
+	for i := range site.Targets {
+		var t = &site.Targets[i]
+		var status = map[int][]ProbeStatus{}
+		for _, a := range site.Addrs {
+			var probe = ProbeResult{SID: site.ID, TID: t.ID, IP: a.IP, Family: a.Family, Scheme: t.Scheme}
+			var tm = newTiming(pr.Now)
+			resp, e := pr.request(httptrace.WithClientTrace(ctx, tm.trace()), "GET", t.URL(site.Domain), a.IP)
+			tm.fill(&probe)
+			probe.Status = classify(e)
+			if e != nil {
+				probe.Error = e.Error()
+			} else {
+				probe.Proto = resp.Proto
+				if !t.expected(resp.StatusCode) {
+					probe.Status, probe.Error = StatusHTTPError, resp.Status
+				}
+			}
+			status[a.Family] = append(status[a.Family], probe.Status)
+			probes = append(probes, probe)
+		}
+		t.V4, t.V6, t.Checked = combine(status[4]), combine(status[6]), pr.Now()
+	}
+	return probes
+}
+
+// parseTarget 从请求参数中读取目标，参数不合法时返回给用户看的错误信息
+func parseTarget(req *http.Request, t *Target) string {
+	t.Scheme = strings.ToLower(req.FormValue("scheme"))
+	if t.Scheme != "http" && t.Scheme != "https" {
+		return "协议只能是 http 或 https"
+	}
+	t.Port, _ = strconv.Atoi(req.FormValue("port"))
+	if t.Port < 0 || t.Port > 65535 {
+		return "端口不合法"
+	}
+	t.Path = req.FormValue("path")
+	if !strings.HasPrefix(t.Path, "/") {
+		t.Path = "/" + t.Path
+	}
+	t.Expect, _ = strconv.Atoi(req.FormValue("expect"))
+	if t.Expect != 0 && (t.Expect < 100 || t.Expect > 599) {
+		return "状态码不合法"
+	}
+	return ""
+}
+
+func targets(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var sid, _ = strconv.Atoi(req.URL.Query().Get("sid"))
+	var site = Site{ID: sid}
+	if _, err := db.Cols("domain").Get(&site); err != nil {
+		panic(err)
+	}
+	var list = []Target{}
+	if err := db.Where("sid = ?", sid).Asc("id").Find(&list); err != nil {
+		panic(err)
+	}
+	for i, t := range list {
+		list[i].Link = t.URL(site.Domain)
+		list[i].V4Text, list[i].V6Text = t.V4.String(), t.V6.String()
+		if t.Checked.IsZero() {
+			list[i].V4Text, list[i].V6Text = "未检测", "未检测"
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	msg, _ := json.Marshal(Er{Ret: "v", Data: list})
+	w.Write(msg)
+}
+
+func addtarget(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var sid, _ = strconv.Atoi(req.FormValue("sid"))
+	res, ge := db.Exist(&Site{ID: sid})
+	if ge != nil {
+		panic(ge)
+	}
+	if !res || sid == 0 {
+		w.WriteHeader(http.StatusOK)
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: "没有这个记录"})
+		w.Write(msg)
+		return
+	}
+	var t = Target{SID: sid}
+	if m := parseTarget(req, &t); m != "" {
+		w.WriteHeader(http.StatusOK)
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: m})
+		w.Write(msg)
+		return
+	}
+	if _, err := db.Insert(&t); err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusOK)
+	msg, _ := json.Marshal(Er{Ret: "v", Msg: "添加完毕", Data: t})
+	w.Write(msg)
+}
+
+func edittarget(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var id, _ = strconv.ParseInt(req.FormValue("id"), 10, 64)
+	var t = Target{ID: id}
+	res, ge := db.Get(&t)
+	if ge != nil {
+		panic(ge)
+	}
+	if !res || id == 0 {
+		w.WriteHeader(http.StatusOK)
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: "没有这个记录"})
+		w.Write(msg)
+		return
+	}
+	if m := parseTarget(req, &t); m != "" {
+		w.WriteHeader(http.StatusOK)
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: m})
+		w.Write(msg)
+		return
+	}
+	if _, err := db.ID(t.ID).MustCols("port", "expect").Update(&t); err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusOK)
+	msg, _ := json.Marshal(Er{Ret: "v", Msg: "修改完毕", Data: t})
+	w.Write(msg)
+}
+
+func deltarget(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var id, _ = strconv.ParseInt(req.FormValue("id"), 10, 64)
+	n, err := db.ID(id).Delete(&Target{})
+	if err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusOK)
+	if n == 0 {
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: "没有这个记录"})
+		w.Write(msg)
+		return
+	}
+	msg, _ := json.Marshal(Er{Ret: "v", Msg: "已删除"})
+	w.Write(msg)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// timing 用 httptrace 记录一次请求各阶段的时间点
+// 请求超时后拨号的 goroutine 可能还会回调，所以要加锁
+type timing struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	start     time.Time
+	connStart time.Time
+	connDone  time.Time
+	tlsStart  time.Time
+	tlsDone   time.Time
+	firstByte time.Time
+}
+
+func newTiming(now func() time.Time) *timing {
+	return &timing{now: now}
+}
+
+func (t *timing) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		//从 Transport 开始取连接时计时，send 中等待限速的时间不算在内
+		GetConn: func(_ string) { t.set(&t.start) },
+		//net.Dialer 和 client 的 DialContext 都会触发，只记第一次开始和最后一次结束
+		ConnectStart: func(_, _ string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.connStart.IsZero() {
+				t.connStart = t.now()
+			}
+		},
+		ConnectDone:          func(_, _ string, _ error) { t.set(&t.connDone) },
+		TLSHandshakeStart:    func() { t.set(&t.tlsStart) },
+		TLSHandshakeDone:     func(_ tls.ConnectionState, _ error) { t.set(&t.tlsDone) },
+		GotFirstResponseByte: func() { t.set(&t.firstByte) },
+	}
+}
+
+func (t *timing) set(p *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*p = t.now()
+}
+
+// fill 把各阶段的耗时写入探测记录，单位毫秒，没有发生的阶段为 0
+func (t *timing) fill(probe *ProbeResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	probe.Latency = millis(t.start, t.now())
+	probe.ConnectTime = millis(t.connStart, t.connDone)
+	probe.TLSTime = millis(t.tlsStart, t.tlsDone)
+	probe.TTFB = millis(t.start, t.firstByte)
+}
+
+func millis(start, end time.Time) int64 {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return int64(end.Sub(start) / time.Millisecond)
+}
+
+// fastest 同一协议族成功的 http https 探测中最短的首字节时间
+func fastest(probes []ProbeResult, v int) int64 {
+	var best int64
+	for _, p := range probes {
+		if p.Family != v || p.Status != StatusOK || (p.Scheme != "http" && p.Scheme != "https") || p.TTFB == 0 {
+			continue
+		}
+		if best == 0 || p.TTFB < best {
+			best = p.TTFB
+		}
+	}
+	return best
+}
+
+// checkLatency 显示 v6 首字节时间是 v4 的几倍，鼠标悬停显示具体数值
+func checkLatency(site Site) string {
+	if site.V6Penalty == 0 {
+		return ""
+	}
+	var class = "btn-success"
+	if site.V6Penalty >= 2 {
+		class = "btn-danger"
+	} else if site.V6Penalty > 1.2 {
+		class = "btn-warning"
+	}
+	var title = fmt.Sprintf("v4 首字节 %dms<br>v6 首字节 %dms", site.V4TTFB, site.V6TTFB)
+	return fmt.Sprintf(`<button type="button" class="btn %s btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">%.1f×</button>`, class, title, site.V6Penalty)
+}
@@ -2,132 +2,356 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strings"
 	"time"
+
+	"github.com/quic-go/quic-go"
 )
 
-func checkDomain(site Site) {
-	ns, err := net.LookupHost(site.Domain)
+// Resolver 域名解析，*net.Resolver 满足该接口
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Dialer 建立连接，*net.Dialer 满足该接口
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// recordResolver 能给出每次查询细节的解析器，比如 DNSClient
+type recordResolver interface {
+	Lookup(ctx context.Context, host string) ([]DNSRecord, error)
+}
+
+// Prober 检测引擎，解析、拨号和时钟都可以替换，方便脱离真实网络运行
+type Prober struct {
+	Resolver  Resolver
+	Dialer    Dialer
+	Now       func() time.Time
+	TLSConfig *tls.Config //为空时使用系统证书
+	Redirect  bool        //是否跟随跳转并记录跳转链
+	Crawl     bool        //是否检查首页引用的第三方资源
+	Timeout   time.Duration
+	Limit     *RateLimiter //连接之前按地址段限速
+	DialQUIC  func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error)
+}
+
+var prober = &Prober{
+	Resolver: net.DefaultResolver,
+	Dialer:   &net.Dialer{},
+	Now:      time.Now,
+	Timeout:  time.Second * 15,
+	DialQUIC: quic.DialAddr,
+}
+
+// checkSite 读取站点配置的检测目标后检测
+func checkSite(ctx context.Context, site Site) checkResult {
+	if e := db.Where("sid = ?", site.ID).Find(&site.Targets); e != nil {
+		log.Printf("load targets %d: %s", site.ID, e)
+	}
+	var r = prober.Check(ctx, site)
+	r.Site.NextCheck, r.Site.Fails = schedule.Next(site, r.Site, time.Now())
+	return r
+}
+
+// resultCols 检测写入 site 表的全部字段，零值也要写入，否则恢复正常的站点
+// 无法清除上一次的 V6Penalty CertMismatch Blockers 等结果
+// 不包括 domain desc skip_variant，检测期间管理员的修改不会被覆盖
+var resultCols = []string{
+	"ipv4", "ipv6",
+	"v6hp", "v4hp", "v6hs", "v4hs", "v6h2", "v4h2", "v6h3", "v4h3",
+	"v6ns", "v6nsq", "v6mx", "v6smtp", "v6rd", "v4hsts", "v6hsts",
+	"parity", "parity_detail", "subhosts", "v6full", "blockers",
+	"v4ttfb", "v6ttfb", "v6penalty",
+	"cert_mismatch", "cetime", "v4cetime", "v6cetime", "certs", "security",
+	"v6time", "next_check", "fails",
+	"addrs", "dns", "hosts", "v6hops", "v4hops", "variants",
+}
+
+// saveResult 保存一次检测的结果，由调度器在同一个 goroutine 中依次调用
+func saveResult(r checkResult) {
+	s, _ := json.Marshal(r.Site)
+	log.Printf("task finish：%s", s)
+	if _, e := db.ID(r.Site.ID).Cols(resultCols...).Update(&r.Site); e != nil {
+		log.Printf("update site %d: %s", r.Site.ID, e)
+	}
+	for _, t := range r.Site.Targets {
+		if _, e := db.ID(t.ID).Cols("v4", "v6", "checked").Update(&t); e != nil {
+			log.Printf("update target %d: %s", t.ID, e)
+		}
+	}
+	if len(r.Probes) > 0 {
+		if _, e := db.Insert(&r.Probes); e != nil {
+			log.Printf("insert probe result %d: %s", r.Site.ID, e)
+		}
+	}
+}
+
+// Check 检测一个站点，返回最新的 Site 和本次每个探测的记录
+func (pr *Prober) Check(ctx context.Context, site Site) checkResult {
+	//每次检测都从头开始，Site 只代表最近一次的结果
+	site.reset()
+	var probes []ProbeResult
+	var ns []string
+	var err error
+	var dnsTime = map[int]int64{} //每个协议族的解析耗时
+	if rr, ok := pr.Resolver.(recordResolver); ok {
+		site.DNS, err = rr.Lookup(ctx, site.Domain)
+		for _, r := range site.DNS {
+			ns = append(ns, r.Addrs...)
+			if r.Type == "AAAA" {
+				dnsTime[6] = r.Time
+			} else {
+				dnsTime[4] = r.Time
+			}
+		}
+	} else {
+		var start = pr.Now()
+		ns, err = pr.Resolver.LookupHost(ctx, site.Domain)
+		dnsTime[4] = millis(start, pr.Now())
+		dnsTime[6] = dnsTime[4]
+	}
 	if err != nil || len(ns) < 1 {
-		ch <- site
-		<-task
-		return
+		var probe = ProbeResult{SID: site.ID, Scheme: "dns", Status: StatusNoRecord}
+		if err != nil {
+			probe.Status, probe.Error = classify(err), err.Error()
+		}
+		var status = probe.Status
+		site.V4hp, site.V6hp, site.V4hs, site.V6hs, site.V4h2, site.V6h2, site.V4h3, site.V6h3 = status, status, status, status, status, status, status, status
+		for i := range site.Targets {
+			site.Targets[i].V4, site.Targets[i].V6, site.Targets[i].Checked = status, status, pr.Now()
+		}
+		return checkResult{Site: site, Probes: []ProbeResult{probe}}
 	}
 	var protocols = []string{"http://", "https://"}
+	var v4, v6 []string
 	for _, s := range ns {
+		var addr = Addr{IP: s, Family: 6, Hp: StatusUnknown, Hs: StatusUnknown, H2: StatusUnknown, H3: StatusUnknown}
+		if net.ParseIP(s).To4() != nil {
+			addr.Family = 4
+			v4 = append(v4, s)
+		} else {
+			v6 = append(v6, s)
+		}
 		for _, p := range protocols {
-			var v int
-			if net.ParseIP(s).To4() != nil {
-				v = 4
-				site.IPv4 = s
-			} else {
-				v = 6
-				site.IPv6 = s
+			var probe = ProbeResult{SID: site.ID, IP: s, Family: addr.Family, Scheme: strings.TrimSuffix(p, "://")}
+			var t = newTiming(pr.Now)
+			resp, e := pr.protocol(httptrace.WithClientTrace(ctx, t.trace()), site.Domain, s, p)
+			if e == nil && resp.TLS != nil {
+				cert, ve := pr.inspect(site.Domain, s, addr.Family, resp.TLS)
+				site.Certs = append(site.Certs, cert)
+				addr.CETime, probe.CETime = cert.NotAfter, cert.NotAfter
+				e = ve
 			}
-			if resp, e := protocol(site.Domain, v, p); e == nil {
-				var protoMajor = resp.ProtoMajor
-				if p == "http://" {
-					if v == 4 {
-						site.V4hp = 2
-					} else if v == 6 {
-						var zero time.Time
-						if zero == site.V6time {
-							site.V6time = time.Now()
-						}
-						site.V6hp = 2
-					}
-				}
-				if p == "https://" {
-					if v == 4 {
-						if protoMajor == 2 {
-							site.V4h2 = 2
-						}
-						site.V4hs = 2
-					} else if v == 6 {
-						var zero time.Time
-						if zero == site.V6time {
-							site.V6time = time.Now()
-						}
-						if protoMajor == 2 {
-							site.V6h2 = 2
-						}
-						site.V6hs = 2
-					}
+			probe.DNSTime = dnsTime[addr.Family]
+			t.fill(&probe)
+			probe.Status = classify(e)
+			//只有 5xx 算 StatusHTTPError，4xx 说明该地址上的服务可以访问，仍算支持
+			//需要检查具体状态码时给站点配置检测目标，见 Target.expected
+			if e == nil && resp.StatusCode >= http.StatusInternalServerError {
+				probe.Status = StatusHTTPError
+				probe.Error = resp.Status
+			}
+			if e != nil {
+				probe.Error = e.Error()
+			}
+			if p == "http://" {
+				addr.Hp = probe.Status
+			} else {
+				addr.Hs = probe.Status
+				addr.H2 = probe.Status
+				if probe.Status == StatusOK && resp.ProtoMajor != 2 {
+					addr.H2 = StatusUnknown
 				}
-				var expirationTime time.Time
-				if resp.TLS != nil {
-					for _, tls := range resp.TLS.PeerCertificates {
-						if expirationTime.IsZero() {
-							expirationTime = tls.NotAfter
-						}
-						if expirationTime.Before(tls.NotAfter) == false {
-							expirationTime = tls.NotAfter
-						}
-					}
+				var header http.Header
+				if resp != nil {
+					header = resp.Header
 				}
-				site.CETime = expirationTime
+				var h3 = pr.checkH3(ctx, site, s, header)
+				addr.H3 = h3.Status
+				probes = append(probes, h3)
+			}
+			if e != nil {
+				probes = append(probes, probe)
+				continue
 			}
+			if p == "https://" {
+				site.Security = append(site.Security, pr.security(ctx, site.Domain, s, addr.Family, resp))
+			}
+			probe.Proto = resp.Proto
+			probes = append(probes, probe)
 		}
+		site.Addrs = append(site.Addrs, addr)
 	}
-	s, _ := json.Marshal(site)
-	log.Printf("task finish：%s", s)
-	ch <- site
-	<-task
-}
-
-func protocol(domain string, v int, p string) (*http.Response, error) {
-	var client *http.Client
-	if v == 4 {
-		client = &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					network = "tcp4" //仅使用ipv4
-					return net.Dial(network, addr)
-				},
-			},
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-			Timeout: time.Second * 15,
-		}
-	} else {
-		client = &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					network = "tcp6" //仅使用ipv6
-					return net.Dial(network, addr)
-				},
-			},
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-			Timeout: time.Second * 15,
-		}
+	site.IPv4 = strings.Join(v4, ",")
+	site.IPv6 = strings.Join(v6, ",")
+	site.V4hp = summarize(site.Addrs, 4, func(a Addr) ProbeStatus { return a.Hp })
+	site.V6hp = summarize(site.Addrs, 6, func(a Addr) ProbeStatus { return a.Hp })
+	site.V4hs = summarize(site.Addrs, 4, func(a Addr) ProbeStatus { return a.Hs })
+	site.V6hs = summarize(site.Addrs, 6, func(a Addr) ProbeStatus { return a.Hs })
+	site.V4h2 = summarize(site.Addrs, 4, func(a Addr) ProbeStatus { return a.H2 })
+	site.V6h2 = summarize(site.Addrs, 6, func(a Addr) ProbeStatus { return a.H2 })
+	site.V4h3 = summarize(site.Addrs, 4, func(a Addr) ProbeStatus { return a.H3 })
+	site.V6h3 = summarize(site.Addrs, 6, func(a Addr) ProbeStatus { return a.H3 })
+	site.V4CETime, site.V6CETime = earliest(site.Addrs, 4), earliest(site.Addrs, 6)
+	site.CETime = site.V4CETime
+	if site.CETime.IsZero() || (!site.V6CETime.IsZero() && site.V6CETime.Before(site.CETime)) {
+		site.CETime = site.V6CETime
 	}
-	var url = fmt.Sprintf("%s%s", p, domain)
-	req, _ := http.NewRequest("HEAD", url, nil)
-	resp, e := client.Do(req)
-	if e != nil {
-		return nil, errors.New("fail")
+	site.CertMismatch = certMismatch(site.Certs)
+	site.V4hsts, site.V6hsts = hstsStatus(site.Security, 4), hstsStatus(site.Security, 6)
+	site.V4TTFB, site.V6TTFB, site.V6Penalty = fastest(probes, 4), fastest(probes, 6), 0
+	if site.V4TTFB > 0 && site.V6TTFB > 0 {
+		site.V6Penalty = float64(site.V6TTFB) / float64(site.V4TTFB)
+	}
+	probes = append(probes, pr.checkInfra(ctx, &site)...)
+	pr.checkVariants(ctx, &site)
+	probes = append(probes, pr.checkTargets(ctx, &site)...)
+	body := pr.parity(ctx, &site)
+	if pr.Crawl {
+		pr.crawl(ctx, &site, body)
 	}
+	site.V4Hops, site.V6Hops, site.V6rd = nil, nil, StatusUnknown
+	if pr.Redirect {
+		site.V4Hops, _ = pr.followRedirects(ctx, site.Domain, 4)
+		site.V6Hops, site.V6rd = pr.followRedirects(ctx, site.Domain, 6)
+	}
+	if site.V6time.IsZero() && (site.V6hp.Supported() || site.V6hs.Supported()) {
+		site.V6time = pr.Now()
+	}
+	return checkResult{Site: site, Probes: probes}
+}
 
-	var expirationTime time.Time
+// reset 清空上一次检测的结果，只保留站点的配置、V6time 和调度信息
+func (site *Site) reset() {
+	site.IPv4, site.IPv6 = "", ""
+	site.V4hp, site.V6hp, site.V4hs, site.V6hs = StatusUnknown, StatusUnknown, StatusUnknown, StatusUnknown
+	site.V4h2, site.V6h2, site.V4h3, site.V6h3 = StatusUnknown, StatusUnknown, StatusUnknown, StatusUnknown
+	site.V6ns, site.V6nsq, site.V6mx, site.V6smtp, site.V6rd = StatusUnknown, StatusUnknown, StatusUnknown, StatusUnknown, StatusUnknown
+	site.V4hsts, site.V6hsts = StatusUnknown, StatusUnknown
+	site.Parity, site.ParityDetail = ParityUnknown, Parity{}
+	site.SubHosts, site.V6Full, site.Blockers = 0, 0, nil
+	site.V4TTFB, site.V6TTFB, site.V6Penalty = 0, 0, 0
+	site.CertMismatch = false
+	site.CETime, site.V4CETime, site.V6CETime = time.Time{}, time.Time{}, time.Time{}
+	site.Addrs, site.DNS, site.Hosts = nil, nil, nil
+	site.V4Hops, site.V6Hops = nil, nil
+	site.Certs, site.Security, site.Variants = nil, nil, nil
+}
 
-	if resp.TLS != nil {
-		for _, tls := range resp.TLS.PeerCertificates {
-			if expirationTime.IsZero() {
-				expirationTime = tls.NotAfter
-			}
-			if expirationTime.Before(tls.NotAfter) == false {
-				expirationTime = tls.NotAfter
-			}
+// summarize 汇总同一协议族下所有地址的结果，规则见 combine
+func summarize(addrs []Addr, v int, pick func(a Addr) ProbeStatus) ProbeStatus {
+	var list []ProbeStatus
+	for _, a := range addrs {
+		if a.Family == v {
+			list = append(list, pick(a))
+		}
+	}
+	return combine(list)
+}
+
+// earliest 同一协议族所有地址中最早过期的证书时间
+func earliest(addrs []Addr, v int) time.Time {
+	var t time.Time
+	for _, a := range addrs {
+		if a.Family != v || a.CETime.IsZero() {
+			continue
+		}
+		if t.IsZero() || a.CETime.Before(t) {
+			t = a.CETime
 		}
 	}
+	return t
+}
+
+// protocol 只连接指定的 ip，这样同一域名的每个地址都能单独检测
+// https 握手时不验证证书，调用方需要用 inspect 验证
+func (pr *Prober) protocol(ctx context.Context, domain string, ip string, p string) (*http.Response, error) {
+	return pr.send(ctx, "HEAD", fmt.Sprintf("%s%s", p, domain), ip, pr.inspectConfig())
+}
+
+// request 向指定的 ip 发出请求，不跟随跳转
+func (pr *Prober) request(ctx context.Context, method string, url string, ip string) (*http.Response, error) {
+	return pr.send(ctx, method, url, ip, pr.TLSConfig)
+}
 
+// send 用给定的 tls 配置向指定的 ip 发出请求
+func (pr *Prober) send(ctx context.Context, method string, url string, ip string, conf *tls.Config) (*http.Response, error) {
+	req, e := http.NewRequestWithContext(ctx, method, url, nil)
+	if e != nil {
+		return nil, e
+	}
+	if e := pr.Limit.WaitIP(ctx, ip); e != nil {
+		return nil, e
+	}
+	resp, e := pr.client(ip, conf).Do(req)
+	if e != nil {
+		return nil, e
+	}
+	resp.Body.Close()
 	return resp, nil
 }
+
+// fetch 向指定的 ip 发出 GET 请求，最多读取 maxBody 字节
+func (pr *Prober) fetch(ctx context.Context, url string, ip string) (*http.Response, []byte, error) {
+	req, e := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if e != nil {
+		return nil, nil, e
+	}
+	if e := pr.Limit.WaitIP(ctx, ip); e != nil {
+		return nil, nil, e
+	}
+	resp, e := pr.client(ip, pr.TLSConfig).Do(req)
+	if e != nil {
+		return nil, nil, e
+	}
+	defer resp.Body.Close()
+	body, e := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	return resp, body, e
+}
+
+// client 返回只连接指定 ip 的 http.Client，限速在 send 和 fetch 中 Do 之前等待
+// 不能放在 DialContext 中：那时 Timeout 已经开始计时，排队久了请求会直接超时
+func (pr *Prober) client(ip string, conf *tls.Config) *http.Client {
+	var network = "tcp6" //仅使用ipv6
+	if net.ParseIP(ip).To4() != nil {
+		network = "tcp4" //仅使用ipv4
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				_, port, e := net.SplitHostPort(addr)
+				if e != nil {
+					return nil, e
+				}
+				//自定义的 Dialer 不一定会触发 httptrace，这里补上
+				var trace = httptrace.ContextClientTrace(ctx)
+				if trace != nil && trace.ConnectStart != nil {
+					trace.ConnectStart(network, addr)
+				}
+				conn, e := pr.Dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+				if trace != nil && trace.ConnectDone != nil {
+					trace.ConnectDone(network, addr, e)
+				}
+				return conn, e
+			},
+			TLSClientConfig: conf,
+			//自定义 DialContext 后默认不再尝试 h2
+			ForceAttemptHTTP2: true,
+			//每次请求都新建 Transport，不保留空闲连接，否则连接和 goroutine 会越积越多
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: pr.Timeout,
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Vantage struct
+// 某个探测节点对站点最近一次的检测结果
+type Vantage struct {
+	ID       int64       `json:"id" xorm:"pk autoincr 'id'"`
+	SID      int         `json:"sid" xorm:"sid index"`
+	Agent    string      `json:"agent" xorm:"agent index"`
+	Location string      `json:"location" xorm:"location"`
+	IPv4     string      `json:"ipv4" xorm:"ipv4"`
+	IPv6     string      `json:"ipv6" xorm:"ipv6"`
+	V4hp     ProbeStatus `json:"v4hp" xorm:"v4hp"`
+	V6hp     ProbeStatus `json:"v6hp" xorm:"v6hp"`
+	V4hs     ProbeStatus `json:"v4hs" xorm:"v4hs"`
+	V6hs     ProbeStatus `json:"v6hs" xorm:"v6hs"`
+	V4h2     ProbeStatus `json:"v4h2" xorm:"v4h2"`
+	V6h2     ProbeStatus `json:"v6h2" xorm:"v6h2"`
+	V4h3     ProbeStatus `json:"v4h3" xorm:"v4h3"`
+	V6h3     ProbeStatus `json:"v6h3" xorm:"v6h3"`
+	V4TTFB   int64       `json:"v4ttfb" xorm:"v4ttfb"`
+	V6TTFB   int64       `json:"v6ttfb" xorm:"v6ttfb"`
+	Checked  time.Time   `json:"checked" xorm:"checked"`
+}
+
+// agentJob 下发给节点的任务
+type agentJob struct {
+	Job  int64 `json:"job"`
+	Site Site  `json:"site"`
+}
+
+// agentReport 节点上报的检测结果
+type agentReport struct {
+	Job      int64         `json:"job"`
+	Location string        `json:"location"`
+	Site     Site          `json:"site"`
+	Probes   []ProbeResult `json:"probes"`
+	Error    string        `json:"error"`
+}
+
+// agentAuth 校验 X-Agent-ID 和 Authorization: Bearer <token>，token 来自 --agent-tokens
+func agentAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		var id = req.Header.Get("X-Agent-ID")
+		var token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		for _, pair := range *agentTokens {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) == 2 && id != "" && kv[0] == id && subtle.ConstantTimeCompare([]byte(kv[1]), []byte(token)) == 1 {
+				h(w, req, ps)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: "unauthorized"})
+		w.Write(msg)
+	}
+}
+
+// agentBatch agentJobs 每次从数据库读取的站点数
+const agentBatch = 500
+
+// agentJobs 给节点分配还没检测或者检测结果已经过期的站点
+func agentJobs(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var agent = req.Header.Get("X-Agent-ID")
+	var n, _ = strconv.Atoi(req.URL.Query().Get("n"))
+	if n <= 0 || n > 100 {
+		n = 10
+	}
+	var now = time.Now()
+	var lease = now.Add(-*jobTimeout * 2)
+	//节点没有按时上报的任务视为失败
+	if _, e := db.Where("agent = ? and state = ? and started <= ?", agent, JobRunning, lease).Cols("state", "last_error").Update(&Job{State: JobFailed, LastError: "lease expired"}); e != nil {
+		panic(e)
+	}
+	var skip = map[int]bool{}
+	var recent []Vantage
+	if e := db.Where("agent = ? and checked > ?", agent, now.Add(-*scInterval)).Cols("sid").Find(&recent); e != nil {
+		panic(e)
+	}
+	for _, v := range recent {
+		skip[v.SID] = true
+	}
+	var running []Job
+	if e := db.Where("agent = ? and state = ?", agent, JobRunning).Cols("sid").Find(&running); e != nil {
+		panic(e)
+	}
+	for _, j := range running {
+		skip[j.SID] = true
+	}
+	var jobs = []agentJob{}
+	//按 id 分批读取站点，凑够 n 个任务就不再往后读
+	for last := 0; len(jobs) < n; {
+		var sites []Site
+		if e := db.Where("id > ?", last).Cols("id", "domain", "skip_variant").Asc("id").Limit(agentBatch).Find(&sites); e != nil {
+			panic(e)
+		}
+		for _, site := range sites {
+			if len(jobs) >= n {
+				break
+			}
+			last = site.ID
+			if skip[site.ID] {
+				continue
+			}
+			if e := db.Where("sid = ?", site.ID).Find(&site.Targets); e != nil {
+				panic(e)
+			}
+			var job = Job{SID: site.ID, Agent: agent, State: JobRunning, Attempts: 1, Started: now}
+			if _, e := db.Insert(&job); e != nil {
+				panic(e)
+			}
+			jobs = append(jobs, agentJob{Job: job.ID, Site: site})
+		}
+		if len(sites) < agentBatch {
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	msg, _ := json.Marshal(Er{Ret: "v", Data: jobs})
+	w.Write(msg)
+}
+
+// agentResults 保存节点上报的结果，只更新该节点的 Vantage，不修改 Site
+func agentResults(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var agent = req.Header.Get("X-Agent-ID")
+	var r agentReport
+	w.Header().Set("Content-Type", "application/json")
+	if e := json.NewDecoder(req.Body).Decode(&r); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: e.Error()})
+		w.Write(msg)
+		return
+	}
+	var job = Job{ID: r.Job}
+	has, e := db.Get(&job)
+	if e != nil {
+		panic(e)
+	}
+	if !has || job.Agent != agent || job.State != JobRunning {
+		msg, _ := json.Marshal(Er{Ret: "e", Msg: "没有这个任务"})
+		w.Write(msg)
+		return
+	}
+	job.Finished = time.Now()
+	if r.Error != "" {
+		job.State, job.LastError = JobFailed, r.Error
+	} else {
+		job.State = JobDone
+		saveVantage(job.SID, agent, r)
+	}
+	if _, e := db.ID(job.ID).Cols("state", "last_error", "finished").Update(&job); e != nil {
+		panic(e)
+	}
+	msg, _ := json.Marshal(Er{Ret: "v"})
+	w.Write(msg)
+}
+
+func saveVantage(sid int, agent string, r agentReport) {
+	var s = r.Site
+	var v = Vantage{
+		SID: sid, Agent: agent, Location: r.Location, IPv4: s.IPv4, IPv6: s.IPv6,
+		V4hp: s.V4hp, V6hp: s.V6hp, V4hs: s.V4hs, V6hs: s.V6hs, V4h2: s.V4h2, V6h2: s.V6h2, V4h3: s.V4h3, V6h3: s.V6h3,
+		V4TTFB: s.V4TTFB, V6TTFB: s.V6TTFB, Checked: time.Now(),
+	}
+	var old = Vantage{SID: v.SID, Agent: agent}
+	has, e := db.Get(&old)
+	if e != nil {
+		panic(e)
+	}
+	if has {
+		_, e = db.ID(old.ID).AllCols().Update(&v)
+	} else {
+		_, e = db.Insert(&v)
+	}
+	if e != nil {
+		panic(e)
+	}
+	for i := range r.Probes {
+		r.Probes[i].ID, r.Probes[i].SID, r.Probes[i].Agent = 0, v.SID, agent
+	}
+	if len(r.Probes) > 0 {
+		if _, e := db.Insert(&r.Probes); e != nil {
+			log.Printf("insert probe result %d from %s: %s", v.SID, agent, e)
+		}
+	}
+}
+
+// statusButton 只根据状态显示，没有地址细节
+func statusButton(p ProbeStatus) string {
+	switch p {
+	case StatusOK:
+		return `<button type="button" class="btn btn-outline-success btn-sm">已支持</button>`
+	case StatusPartial:
+		return `<button type="button" class="btn btn-outline-warning btn-sm">部分支持</button>`
+	case StatusUnknown, 0:
+		return `<button type="button" class="btn btn-outline-danger btn-sm">不支持</button>`
+	}
+	return fmt.Sprintf(`<button type="button" class="btn btn-outline-danger btn-sm" data-toggle="tooltip" data-placement="top" title="%s">不支持</button>`, p)
+}
+
+// vantage 列出各个节点对一个站点的最近结果，第一行是本机
+func vantage(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var id, _ = strconv.Atoi(req.URL.Query().Get("id"))
+	var site = Site{ID: id}
+	has, e := db.Get(&site)
+	if e != nil {
+		panic(e)
+	}
+	if !has {
+		return
+	}
+	var list []Vantage
+	if e := db.Where("sid = ?", id).Asc("agent").Find(&list); e != nil {
+		panic(e)
+	}
+	var local = Vantage{
+		SID: site.ID, Location: "本机", IPv4: site.IPv4, IPv6: site.IPv6,
+		V4hp: site.V4hp, V6hp: site.V6hp, V4hs: site.V4hs, V6hs: site.V6hs, V4h2: site.V4h2, V6h2: site.V6h2, V4h3: site.V4h3, V6h3: site.V6h3,
+		V4TTFB: site.V4TTFB, V6TTFB: site.V6TTFB, Checked: site.Updated,
+	}
+	list = append([]Vantage{local}, list...)
+	var dom = `{{range $k,$v := .list}}
+	<tr>
+		<td class="align-middle">{{html $v.Agent}} {{html $v.Location}}</td>
+		<td>{{statusButton $v.V4hp}}</td>
+		<td>{{statusButton $v.V4hs}}</td>
+		<td>{{statusButton $v.V6hp}}</td>
+		<td>{{statusButton $v.V6hs}}</td>
+		<td>{{statusButton $v.V6h2}}</td>
+		<td>{{statusButton $v.V6h3}}</td>
+		<td class="align-middle">{{$v.V4TTFB}}ms / {{$v.V6TTFB}}ms</td>
+		<td class="align-middle">{{$v.Checked.Format "2006-01-02 15:04"}}</td>
+	</tr>
+	{{end}}`
+	t, _ := template.New("dom").Funcs(template.FuncMap{"statusButton": statusButton}).Parse(dom)
+	t.Execute(w, map[string]interface{}{"list": list})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Variant struct
+// www 与主域名其中一种写法的检测结果
+type Variant struct {
+	Domain string      `json:"domain"`
+	IPv4   string      `json:"ipv4"`
+	IPv6   string      `json:"ipv6"`
+	V4hp   ProbeStatus `json:"v4hp"`
+	V6hp   ProbeStatus `json:"v6hp"`
+	V4hs   ProbeStatus `json:"v4hs"`
+	V6hs   ProbeStatus `json:"v6hs"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Ready 通过 v6 能访问 http 或 https
+func (v Variant) Ready() bool {
+	return v.V6hp.Supported() || v.V6hs.Supported()
+}
+
+// variantDomains 返回主域名和 www 两种写法，site.Domain 在前
+// 只有可注册域名（如 example.edu.cn）和它的 www 有两种写法，mail.cs.example.edu.cn 这样的子域名只返回自身
+func variantDomains(domain string) []string {
+	var apex = strings.TrimPrefix(domain, "www.")
+	if d, e := publicsuffix.EffectiveTLDPlusOne(apex); e != nil || d != apex {
+		return []string{domain}
+	}
+	if apex != domain {
+		return []string{domain, apex}
+	}
+	return []string{domain, "www." + domain}
+}
+
+// checkVariants 分别检测 www 和主域名，主域名已经检测过，直接用 site 中的结果
+func (pr *Prober) checkVariants(ctx context.Context, site *Site) {
+	site.Variants = nil
+	if site.SkipVariant {
+		return
+	}
+	var domains = variantDomains(site.Domain)
+	if len(domains) < 2 {
+		return
+	}
+	for i, domain := range domains {
+		if i == 0 {
+			site.Variants = append(site.Variants, Variant{
+				Domain: domain, IPv4: site.IPv4, IPv6: site.IPv6,
+				V4hp: site.V4hp, V6hp: site.V6hp, V4hs: site.V4hs, V6hs: site.V6hs,
+			})
+			continue
+		}
+		site.Variants = append(site.Variants, pr.variant(ctx, domain))
+	}
+}
+
+// variant 只检测 http 和 https，不做 h2 h3 和证书以外的检查
+func (pr *Prober) variant(ctx context.Context, domain string) Variant {
+	var v = Variant{Domain: domain}
+	ns, e := pr.Resolver.LookupHost(ctx, domain)
+	if e != nil || len(ns) < 1 {
+		var status = StatusNoRecord
+		if e != nil {
+			status, v.Error = classify(e), e.Error()
+		}
+		v.V4hp, v.V6hp, v.V4hs, v.V6hs = status, status, status, status
+		return v
+	}
+	var addrs []Addr
+	var v4, v6 []string
+	for _, ip := range ns {
+		var addr = Addr{IP: ip, Family: 6}
+		if net.ParseIP(ip).To4() != nil {
+			addr.Family = 4
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+		_, e := pr.protocol(ctx, domain, ip, "http://")
+		addr.Hp = classify(e)
+		resp, e := pr.protocol(ctx, domain, ip, "https://")
+		if e == nil && resp.TLS != nil {
+			_, e = pr.inspect(domain, ip, addr.Family, resp.TLS)
+		}
+		addr.Hs = classify(e)
+		addrs = append(addrs, addr)
+	}
+	v.IPv4, v.IPv6 = strings.Join(v4, ","), strings.Join(v6, ",")
+	v.V4hp = summarize(addrs, 4, func(a Addr) ProbeStatus { return a.Hp })
+	v.V6hp = summarize(addrs, 6, func(a Addr) ProbeStatus { return a.Hp })
+	v.V4hs = summarize(addrs, 4, func(a Addr) ProbeStatus { return a.Hs })
+	v.V6hs = summarize(addrs, 6, func(a Addr) ProbeStatus { return a.Hs })
+	return v
+}
+
+// checkVariant 显示 www 和主域名哪个写法支持 v6
+func checkVariant(site Site) string {
+	var buttons []string
+	for _, v := range site.Variants {
+		var class = "btn-outline-secondary"
+		if v.Ready() {
+			class = "btn-outline-success"
+		}
+		var title = fmt.Sprintf("v6 http %s<br>v6 https %s", v.V6hp, v.V6hs)
+		if v.IPv6 == "" {
+			title = "没有 AAAA 记录"
+		}
+		buttons = append(buttons, fmt.Sprintf(`<button type="button" class="btn %s btn-sm" data-toggle="tooltip" data-placement="top" data-html="true" title="%s">%s</button>`, class, title, v.Domain))
+	}
+	return strings.Join(buttons, " ")
+}